@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phayes/hookserve/hookserve"
+)
+
+// Remote build agents take builds from this server, the coordinator, over HTTP. An agent long-polls
+// /agent/poll for a pending event matching its labels, then reports on the build under
+// /agent/builds/<id>/<run>/: it posts its log as it goes, a heartbeat every agentHeartbeatInterval,
+// the matrix if the build turns out to have one, and finally its status. The coordinator requeues
+// the builds of agents that stop sending heartbeats.
+
+const (
+	// agentHeartbeatInterval is how often an agent tells the coordinator that it is still building
+	agentHeartbeatInterval = 10 * time.Second
+
+	// agentPollTimeout is how long a poll for a build is held open when there is nothing to build
+	agentPollTimeout = 30 * time.Second
+)
+
+// An agentBuild is an event handed to an agent to build
+type agentBuild struct {
+	ID       int
+	Run      int
+	Domain   string
+	Job      int
+	Matrix   string
+	Event    hookserve.Event
+	Labels   string
+	CloneURL string
+	Since    string // Revision to compare the commit with for path filters, see checkFilters()
+	Paths    Filter // Path filters from the coordinator's deadci.ini
+}
+
+// An agentMatrix is the matrix of a build, as reported by an agent so that the coordinator can queue its jobs
+type agentMatrix struct {
+	Jobs   []string
+	Labels string // Labels the build turned out to need, which its jobs need too
+}
+
+// An agentResult is the outcome of a build, as reported by an agent
+type agentResult struct {
+	Status string
+	Error  string
+	Labels string // Labels the build turned out to need
+}
+
+// Agents tracks which agent is building which event
+var Agents = &agentRegistry{leases: make(map[int]*agentLease)}
+
+// An agentLease is held by an agent while it builds an event
+type agentLease struct {
+	Agent    string
+	Run      int
+	LastSeen time.Time
+}
+
+type agentRegistry struct {
+	sync.Mutex
+	leases map[int]*agentLease // Keyed by event ID
+}
+
+// Lease records that the agent has started building the event
+func (a *agentRegistry) Lease(agent string, e *Event) {
+	a.Lock()
+	a.leases[e.ID] = &agentLease{Agent: agent, Run: e.RunNumber, LastSeen: time.Now()}
+	a.Unlock()
+}
+
+// Renew checks that the agent is still meant to be building the run of the event, returning the event if it is.
+// Only the agent holding the lease on the run can renew it. Builds left running when the coordinator restarts are
+// put back in the queue, so their agents are told to stop.
+func (a *agentRegistry) Renew(agent string, id, run int) (*Event, error) {
+	a.Lock()
+	defer a.Unlock()
+	lease, ok := a.leases[id]
+	if !ok || lease.Agent != agent || lease.Run != run {
+		return nil, nil
+	}
+	e, err := GetEventByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Status != StatusRunning || e.RunNumber != run {
+		delete(a.leases, id)
+		return nil, nil
+	}
+	lease.LastSeen = time.Now()
+	return e, nil
+}
+
+// Release forgets the lease on the event once its agent has finished building it
+func (a *agentRegistry) Release(id int) {
+	a.Lock()
+	delete(a.leases, id)
+	a.Unlock()
+}
+
+// Reap requeues the builds of agents that have not been heard from within the timeout
+func (a *agentRegistry) Reap(timeout time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	for id, lease := range a.leases {
+		if time.Since(lease.LastSeen) < timeout {
+			continue
+		}
+		delete(a.leases, id)
+		e, err := GetEventByID(id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if e == nil || e.Status != StatusRunning || e.RunNumber != lease.Run {
+			continue
+		}
+		e.AppendLog([]byte("\nAgent " + lease.Agent + " stopped responding. Requeued.\n"))
+		e.Status = StatusPending
+		err = e.Update()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		err = e.Report()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// StartAgents serves the agent API and starts requeueing the builds of lost agents, if agents are enabled
+func StartAgents() {
+	if !Config.Agents.Enabled {
+		return
+	}
+	http.HandleFunc("/agent/", handleAgent)
+	go func() {
+		for range time.Tick(agentHeartbeatInterval) {
+			Agents.Reap(Config.Agents.Timeout)
+		}
+	}()
+}
+
+// Handle requests from agents
+func handleAgent(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+Config.Agents.Secret)) != 1 {
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := r.Header.Get("X-DeadCI-Agent")
+	if agent == "" {
+		http.Error(w, "Missing X-DeadCI-Agent header", http.StatusBadRequest)
+		return
+	}
+
+	// /agent/poll or /agent/builds/<id>/<run>/<action>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 2 && parts[1] == "poll" {
+		handleAgentPoll(agent, w, r)
+		return
+	}
+	if len(parts) != 5 || parts[1] != "builds" {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	run, err := strconv.Atoi(parts[3])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Leases are held by the server that handed out the build, which also keeps its log
+	if current, err := GetEventByID(id); err == nil && current != nil && onOtherNode(current.Node, r) {
+		forwardToNode(current.Node, w, r)
+		return
+	}
+	event, err := Agents.Renew(agent, id, run)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		// The build was cancelled, or requeued and perhaps given to someone else. The agent should stop.
+		http.Error(w, "This build is no longer running on "+agent, http.StatusConflict)
+		return
+	}
+
+	switch parts[4] {
+	case "heartbeat":
+		err = nil
+	case "log":
+		var p []byte
+		p, err = ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = event.AppendLog(p)
+		}
+	case "matrix":
+		matrix := agentMatrix{}
+		err = json.NewDecoder(r.Body).Decode(&matrix)
+		if err == nil {
+			event.Labels = matrix.Labels
+			err = event.expandMatrix(matrix.Jobs)
+		}
+	case "finish":
+		result := agentResult{}
+		err = json.NewDecoder(r.Body).Decode(&result)
+		if err == nil && !IsFinal(result.Status) && result.Status != StatusRunning && result.Status != StatusPending {
+			err = errors.New("Unknown status: " + result.Status)
+		}
+		if err == nil {
+			Agents.Release(id)
+			event.Labels = result.Labels
+			var buildErr error
+			if result.Error != "" {
+				buildErr = errors.New(result.Error)
+			}
+			err = event.Finalize(result.Status, buildErr)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Hand the agent the next pending event it has the labels for, waiting a while for one if there are none
+func handleAgentPoll(agent string, w http.ResponseWriter, r *http.Request) {
+	labels := strings.Fields(strings.ToLower(strings.Replace(r.URL.Query().Get("labels"), ",", " ", -1)))
+	timeout := time.After(agentPollTimeout)
+	for !InShutdown {
+		changed := Queue.Changed()
+		event, err := PopEvent(acceptEvents(labels))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if event != nil {
+			Agents.Lease(agent, event)
+			event.AppendLog([]byte("Building on agent " + agent + "\n"))
+			err = event.Report()
+			if err != nil {
+				// If we can't update the status on the source-control system, then just log it and continue
+				event.AppendLog([]byte(err.Error() + "\n"))
+				log.Println(err)
+			}
+			provider, err := GetProvider(event.Domain)
+			if err != nil {
+				Agents.Release(event.ID)
+				err = event.Finalize(StatusFailedBoot, err)
+				if err != nil {
+					log.Println(err)
+				}
+				continue
+			}
+			since, err := event.diffBase()
+			if err != nil {
+				log.Println(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(agentBuild{
+				ID:       event.ID,
+				Run:      event.RunNumber,
+				Domain:   event.Domain,
+				Job:      event.Job,
+				Matrix:   event.Matrix,
+				Event:    event.Event,
+				Labels:   event.Labels,
+				CloneURL: provider.CloneURL(event),
+				Since:    since,
+				Paths:    Config.Paths,
+			})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
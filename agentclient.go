@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// agentRetryInterval is how long an agent waits before trying again when the coordinator can't be reached
+	agentRetryInterval = 5 * time.Second
+
+	// agentFinishAttempts is how many times an agent tries to report the status of a finished build
+	agentFinishAttempts = 12
+)
+
+// ErrLeaseLost is returned when the coordinator no longer wants the agent to carry on with a build
+var ErrLeaseLost = errors.New("the coordinator has stopped this build")
+
+// agentClient talks to the coordinator on behalf of `deadci agent`
+type agentClient struct {
+	http *http.Client
+}
+
+// remoteBuild connects an event being built by this agent to the coordinator it came from.
+// Its log, and its matrix if it has one, are sent to the coordinator rather than kept here.
+type remoteBuild struct {
+	client   *agentClient
+	cloneURL string
+	since    string
+	paths    Filter
+	logSize  int
+}
+
+// runAgent is run as `deadci agent`. It takes builds from the coordinator named in the [agent] section
+// of deadci.ini and runs them here, with the executor configured in this machine's deadci.ini.
+func runAgent(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: deadci agent [--data-dir=<dir>]")
+		os.Exit(2)
+	}
+	if Config.Agent.Coordinator == "" || Config.Agent.Secret == "" {
+		fmt.Fprintln(os.Stderr, "deadci agent: please set coordinator and secret in the [agent] section of deadci.ini")
+		os.Exit(1)
+	}
+	InitExecutor()
+
+	client := &agentClient{http: &http.Client{Timeout: agentPollTimeout + 30*time.Second}}
+	fmt.Println("Taking builds from " + Config.Agent.Coordinator + " as " + Config.Agent.Name)
+
+	var running sync.WaitGroup
+	for i := 1; i <= Config.Agent.Workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for !InShutdown {
+				build, err := client.poll()
+				if err != nil {
+					log.Println(err)
+					time.Sleep(agentRetryInterval)
+				} else if build != nil {
+					client.build(build)
+				}
+			}
+		}()
+	}
+
+	// Handle a sigint to gracefully shutdown, and a sigquit to shut down immediately
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGQUIT {
+				fmt.Println("Got quit signal. Shutting down immidaitely. To shutdown gracefully, use sigint.")
+				BuildExecutor.Shutdown()
+				os.Exit(1)
+			}
+			fmt.Println("Got shutdown signal. Will shutdown when actively running jobs are finished. To shutdown immidaitely, use sigquit.")
+			InShutdown = true
+		}
+	}()
+	running.Wait()
+	log.Println("Shutting down")
+}
+
+// post sends a request to the coordinator, returning ErrLeaseLost if it no longer wants the build
+func (c *agentClient) post(path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", Config.Agent.Coordinator+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+Config.Agent.Secret)
+	req.Header.Set("X-DeadCI-Agent", Config.Agent.Name)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return resp, nil
+	case http.StatusConflict:
+		resp.Body.Close()
+		return nil, ErrLeaseLost
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return nil, errors.New("coordinator: " + resp.Status + ": " + strings.TrimSpace(string(msg)))
+}
+
+// poll waits for the coordinator to hand out a build, returning nil if it has none for now
+func (c *agentClient) poll() (*agentBuild, error) {
+	resp, err := c.post("/agent/poll?labels="+url.QueryEscape(strings.Join(Config.Agent.Labels, ",")), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	build := &agentBuild{}
+	err = json.NewDecoder(resp.Body).Decode(build)
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// send posts to a path under the build of the event
+func (c *agentClient) send(e *Event, action string, body []byte) error {
+	resp, err := c.post("/agent/builds/"+strconv.Itoa(e.ID)+"/"+strconv.Itoa(e.RunNumber)+"/"+action, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// build runs a build handed out by the coordinator and reports how it went
+func (c *agentClient) build(b *agentBuild) {
+	e := &Event{
+		Event:     b.Event,
+		ID:        b.ID,
+		Domain:    b.Domain,
+		Status:    StatusRunning,
+		Job:       b.Job,
+		Matrix:    b.Matrix,
+		RunNumber: b.Run,
+		Labels:    b.Labels,
+		remote:    &remoteBuild{client: c, cloneURL: b.CloneURL, since: b.Since, paths: b.Paths},
+	}
+	log.Println("Building " + e.Path())
+
+	// Keep the lease on the build while it runs, stopping if the coordinator no longer wants it
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(agentHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := c.send(e, "heartbeat", nil)
+				if err == ErrLeaseLost {
+					RunningBuilds.Cancel(e, ErrCancelled)
+				} else if err != nil {
+					log.Println(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	status, err := e.Run(Config.Agent.Labels)
+	close(done)
+
+	result := agentResult{Status: status, Labels: e.Labels}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	body, _ := json.Marshal(result)
+	for attempt := 1; ; attempt++ {
+		err = c.send(e, "finish", body)
+		if err == nil || err == ErrLeaseLost {
+			break
+		}
+		// Keep trying for a while in case the coordinator is restarting. It requeues the build if we give up.
+		log.Println(err)
+		if attempt == agentFinishAttempts {
+			log.Println("Giving up on reporting " + e.Path())
+			return
+		}
+		time.Sleep(agentRetryInterval)
+	}
+	log.Println("Built " + e.Path() + ": " + status)
+}
+
+// AppendLog sends output to the coordinator, stopping the build if the coordinator no longer wants it
+func (r *remoteBuild) AppendLog(e *Event, p []byte) error {
+	err := r.client.send(e, "log", p)
+	if err == ErrLeaseLost {
+		RunningBuilds.Cancel(e, ErrCancelled)
+	}
+	if err != nil {
+		return err
+	}
+	r.logSize += len(p)
+	return nil
+}
+
+// ExpandMatrix asks the coordinator to queue the jobs of a matrix build
+func (r *remoteBuild) ExpandMatrix(e *Event, matrix []string) error {
+	body, err := json.Marshal(agentMatrix{Jobs: matrix, Labels: e.Labels})
+	if err != nil {
+		return err
+	}
+	return r.client.send(e, "matrix", body)
+}
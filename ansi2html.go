@@ -1,391 +1,474 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"html"
 	"io"
-	"io/ioutil"
-	"log"
-	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-// ANSI2HTML transforms coloured ANSI console output into coloured HTML
-func ANSI2HTML(ansi string) (io.ReadCloser, error) {
-	// Run the results through html2ansi script
-	html2ansi := exec.Command("sh", Config.DataDir+"/ansi2html.sh", "--bg=dark")
-	in, err := html2ansi.StdinPipe()
+// ANSI2HTML transforms coloured ANSI console output read from r into coloured HTML written to w.
+// The output is a series of lines suitable for placing inside a <pre> element.
+func ANSI2HTML(w io.Writer, r io.Reader) error {
+	c := NewANSIConverter(w)
+	_, err := io.Copy(c, r)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	out, err := html2ansi.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-
-	go func() {
-		err = html2ansi.Start()
-		if err != nil {
-			log.Println(err)
-		}
-		in.Write([]byte(ansi))
-		in.Close()
-
-		err = html2ansi.Wait()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
-	return out, nil
+	return c.Flush()
 }
 
-// InitANSI2HTML writes the ansi2html script out to a file so it can be used
-// @@TODO: We really ought to have an ansi2html golang library, but it doesn't exist yet
-func InitANSI2HTML() {
-	err := ioutil.WriteFile(Config.DataDir+"/ansi2html.sh", []byte(ansi2htmlScript), 0700)
-	if err != nil {
-		log.Fatal(err)
-	}
+// The linux console palette, as used by the pixelbeat ansi2html.sh script DeadCI used to ship with.
+var ansiPalette = [16]string{
+	"000000", "AA0000", "00AA00", "AA5500", "0000AA", "AA00AA", "00AAAA", "AAAAAA",
+	"555555", "FF5555", "55FF55", "FFFF55", "5555FF", "FF55FF", "55FFFF", "FFFFFF",
 }
 
-var ansi2htmlScript = `
-#!/bin/sh
-
-# Convert ANSI (terminal) colours and attributes to HTML
-
-# Licence: LGPLv2
-# Author:
-#    http://www.pixelbeat.org/docs/terminal_colours/
-# Examples:
-#    ls -l --color=always | ansi2html.sh > ls.html
-#    git show --color | ansi2html.sh > last_change.html
-#    Generally one can use the "script" util to capture full terminal output.
-# Changes:
-#    V0.1, 24 Apr 2008, Initial release
-#    V0.2, 01 Jan 2009, Phil Harnish <philharnish@gmail.com>
-#                         Support "git diff --color" output by
-#                         matching ANSI codes that specify only
-#                         bold or background colour.
-#                       P@draigBrady.com
-#                         Support "ls --color" output by stripping
-#                         redundant leading 0s from ANSI codes.
-#                         Support "grep --color=always" by stripping
-#                         unhandled ANSI codes (specifically ^[[K).
-#    V0.3, 20 Mar 2009, http://eexpress.blog.ubuntu.org.cn/
-#                         Remove cat -v usage which mangled non ascii input.
-#                         Cleanup regular expressions used.
-#                         Support other attributes like reverse, ...
-#                       P@draigBrady.com
-#                         Correctly nest <span> tags (even across lines).
-#                         Add a command line option to use a dark background.
-#                         Strip more terminal control codes.
-#    V0.4, 17 Sep 2009, P@draigBrady.com
-#                         Handle codes with combined attributes and color.
-#                         Handle isolated <bold> attributes with css.
-#                         Strip more terminal control codes.
-#    V0.15, 16 Oct 2013
-#      http://github.com/pixelb/scripts/commits/master/scripts/ansi2<.sh
-
-if [ "$1" = "--version" ]; then
-    printf '0.15\n' && exit
-fi
-
-if [ "$1" = "--help" ]; then
-    printf '%s\n' \
-'This utility converts ANSI codes in data passed to stdin
-It has 2 optional parameters:
-   --bg=dark --palette=linux|solarized|tango|xterm
-E.g.: ls -l --color=always | ansi2html.sh --bg=dark > ls.html' >&2
-    exit
-fi
-
-[ "$1" = "--bg=dark" ] && { dark_bg=yes; shift; }
-
-if [ "$1" = "--palette=solarized" ]; then
-   # See http://ethanschoonover.com/solarized
-   P0=073642;  P1=D30102;  P2=859900;  P3=B58900;
-   P4=268BD2;  P5=D33682;  P6=2AA198;  P7=EEE8D5;
-   P8=002B36;  P9=CB4B16; P10=586E75; P11=657B83;
-  P12=839496; P13=6C71C4; P14=93A1A1; P15=FDF6E3;
-  shift;
-elif [ "$1" = "--palette=solarized-xterm" ]; then
-   # Above mapped onto the xterm 256 color palette
-   P0=262626;  P1=AF0000;  P2=5F8700;  P3=AF8700;
-   P4=0087FF;  P5=AF005F;  P6=00AFAF;  P7=E4E4E4;
-   P8=1C1C1C;  P9=D75F00; P10=585858; P11=626262;
-  P12=808080; P13=5F5FAF; P14=8A8A8A; P15=FFFFD7;
-  shift;
-elif [ "$1" = "--palette=tango" ]; then
-   # Gnome default
-   P0=000000;  P1=CC0000;  P2=4E9A06;  P3=C4A000;
-   P4=3465A4;  P5=75507B;  P6=06989A;  P7=D3D7CF;
-   P8=555753;  P9=EF2929; P10=8AE234; P11=FCE94F;
-  P12=729FCF; P13=AD7FA8; P14=34E2E2; P15=EEEEEC;
-  shift;
-elif [ "$1" = "--palette=xterm" ]; then
-   P0=000000;  P1=CD0000;  P2=00CD00;  P3=CDCD00;
-   P4=0000EE;  P5=CD00CD;  P6=00CDCD;  P7=E5E5E5;
-   P8=7F7F7F;  P9=FF0000; P10=00FF00; P11=FFFF00;
-  P12=5C5CFF; P13=FF00FF; P14=00FFFF; P15=FFFFFF;
-  shift;
-else # linux console
-   P0=000000;  P1=AA0000;  P2=00AA00;  P3=AA5500;
-   P4=0000AA;  P5=AA00AA;  P6=00AAAA;  P7=AAAAAA;
-   P8=555555;  P9=FF5555; P10=55FF55; P11=FFFF55;
-  P12=5555FF; P13=FF55FF; P14=55FFFF; P15=FFFFFF;
-  [ "$1" = "--palette=linux" ] && shift
-fi
-
-[ "$1" = "--bg=dark" ] && { dark_bg=yes; shift; }
-
-# Mac OSX's GNU sed is installed as gsed
-# use e.g. homebrew 'gnu-sed' to get it
-if ! sed --version >/dev/null 2>&1; then
-  if gsed --version >/dev/null 2>&1; then
-    alias sed=gsed
-  else
-    echo "Error, can't find an acceptable GNU sed." >&2
-    exit 1
-  fi
-fi
-
-printf '%s' "
-<style type=\"text/css\">
-.ef0,.f0 { color: #$P0; } .eb0,.b0 { background-color: #$P0; }
-.ef1,.f1 { color: #$P1; } .eb1,.b1 { background-color: #$P1; }
-.ef2,.f2 { color: #$P2; } .eb2,.b2 { background-color: #$P2; }
-.ef3,.f3 { color: #$P3; } .eb3,.b3 { background-color: #$P3; }
-.ef4,.f4 { color: #$P4; } .eb4,.b4 { background-color: #$P4; }
-.ef5,.f5 { color: #$P5; } .eb5,.b5 { background-color: #$P5; }
-.ef6,.f6 { color: #$P6; } .eb6,.b6 { background-color: #$P6; }
-.ef7,.f7 { color: #$P7; } .eb7,.b7 { background-color: #$P7; }
-.ef8, .f0 > .bold,.bold > .f0 { color: #$P8; font-weight: normal; }
-.ef9, .f1 > .bold,.bold > .f1 { color: #$P9; font-weight: normal; }
-.ef10,.f2 > .bold,.bold > .f2 { color: #$P10; font-weight: normal; }
-.ef11,.f3 > .bold,.bold > .f3 { color: #$P11; font-weight: normal; }
-.ef12,.f4 > .bold,.bold > .f4 { color: #$P12; font-weight: normal; }
-.ef13,.f5 > .bold,.bold > .f5 { color: #$P13; font-weight: normal; }
-.ef14,.f6 > .bold,.bold > .f6 { color: #$P14; font-weight: normal; }
-.ef15,.f7 > .bold,.bold > .f7 { color: #$P15; font-weight: normal; }
-.eb8  { background-color: #$P8; }
-.eb9  { background-color: #$P9; }
-.eb10 { background-color: #$P10; }
-.eb11 { background-color: #$P11; }
-.eb12 { background-color: #$P12; }
-.eb13 { background-color: #$P13; }
-.eb14 { background-color: #$P14; }
-.eb15 { background-color: #$P15; }
-"
-
-# The default xterm 256 colour palette
-for red in $(seq 0 5); do
-  for green in $(seq 0 5); do
-    for blue in $(seq 0 5); do
-        c=$((16 + ($red * 36) + ($green * 6) + $blue))
-        r=$((($red * 40 + 55) * ($red > 0)))
-        g=$((($green * 40 + 55) * ($green > 0)))
-        b=$((($blue * 40 + 55) * ($blue > 0)))
-        printf ".ef%d { color: #%2.2x%2.2x%2.2x; } " $c $r $g $b
-        printf ".eb%d { background-color: #%2.2x%2.2x%2.2x; }\n" $c $r $g $b
-    done
-  done
-done
-for gray in $(seq 0 23); do
-  c=$(($gray+232))
-  l=$(($gray*10 + 8))
-  printf ".ef%d { color: #%2.2x%2.2x%2.2x; } " $c $l $l $l
-  printf ".eb%d { background-color: #%2.2x%2.2x%2.2x; }\n" $c $l $l $l
-done
+// Default foreground and background colours for a dark background
+const (
+	ansiDefaultFg = "AAAAAA"
+	ansiDefaultBg = "000000"
+)
 
-printf '%s' '
-.f9 { color: '` + "`" + `[ "$dark_bg" ] && printf "#$P7;" || printf "#$P0;"` + "`" + `' }
-.b9 { background-color: #'` + "`" + `[ "$dark_bg" ] && printf $P0 || printf $P15` + "`" + `'; }
-.f9 > .bold,.bold > .f9, body.f9 > pre > .bold {
-  /* Bold is heavy black on white, or bright white
-     depending on the default background */
-  color: '` + "`" + `[ "$dark_bg" ] && printf "#$P15;" || printf "#$P0;"` + "`" + `'
-  font-weight: '` + "`" + `[ "$dark_bg" ] && printf 'normal;' || printf 'bold;'` + "`" + `'
+// ansiColor is either unset, an index into the 256 colour xterm palette, or a truecolor RGB value
+type ansiColor struct {
+	set   bool
+	rgb   bool
+	index int
+	r     int
+	g     int
+	b     int
 }
-.reverse {
-  /* CSS doesnt support swapping fg and bg colours unfortunately,
-     so just hardcode something that will look OK on all backgrounds. */
-  '"color: #$P0; background-color: #$P7;"'
-}
-.underline { text-decoration: underline; }
-.line-through { text-decoration: line-through; }
-.blink { text-decoration: blink; }
-
-</style>
-
-<div class="f9 b9">
-<pre>
-'
-
-p='\x1b\['        #shortcut to match escape codes
-P="\(^[^°]*\)¡$p" #expression to match prepended codes below
-
-# Handle various xterm control sequences.
-# See /usr/share/doc/xterm-*/ctlseqs.txt
-sed "
-s#\x1b[^\x1b]*\x1b\\\##g  # strip anything between \e and ST
-s#\x1b][0-9]*;[^\a]*\a##g # strip any OSC (xterm title etc.)
-
-#handle carriage returns
-s#^.*\r\{1,\}\([^$]\)#\1#
-s#\r\$## # strip trailing \r
 
-# strip other non SGR escape sequences
-s#[\x07]##g
-s#\x1b[]>=\][0-9;]*##g
-s#\x1bP+.\{5\}##g
-s#${p}[0-9;?]*[^0-9;?m]##g
-
-#remove backspace chars and what they're backspacing over
-:rm_bs
-s#[^\x08]\x08##g; t rm_bs
-" |
-
-# Normalize the input before transformation
-sed "
-# escape HTML
-s#&#\&amp;#g; s#>#\&gt;#g; s#<#\&lt;#g; s#\"#\&quot;#g
-
-# normalize SGR codes a little
-
-# split 256 colors out and mark so that they're not
-# recognised by the following 'split combined' line
-:e
-s#${p}\([0-9;]\{1,\}\);\([34]8;5;[0-9]\{1,3\}\)m#${p}\1m${p}¬\2m#g; t e
-s#${p}\([34]8;5;[0-9]\{1,3\}\)m#${p}¬\1m#g;
+func (c ansiColor) hex(bold bool) string {
+	if c.rgb {
+		return fmt.Sprintf("%02X%02X%02X", c.r, c.g, c.b)
+	}
+	switch {
+	case c.index < 8 && bold:
+		// Bold basic colours are rendered using their bright variant
+		return ansiPalette[c.index+8]
+	case c.index < 16:
+		return ansiPalette[c.index]
+	case c.index < 232:
+		// 6x6x6 colour cube
+		i := c.index - 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return v*40 + 55
+		}
+		return fmt.Sprintf("%02X%02X%02X", level(i/36), level((i/6)%6), level(i%6))
+	default:
+		// Greyscale ramp
+		l := (c.index-232)*10 + 8
+		return fmt.Sprintf("%02X%02X%02X", l, l, l)
+	}
+}
 
-:c
-s#${p}\([0-9]\{1,\}\);\([0-9;]\{1,\}\)m#${p}\1m${p}\2m#g; t c   # split combined
-s#${p}0\([0-7]\)#${p}\1#g                                 #strip leading 0
-s#${p}1m\(\(${p}[4579]m\)*\)#\1${p}1m#g                   #bold last (with clr)
-s#${p}m#${p}0m#g                                          #add leading 0 to norm
+type ansiStyle struct {
+	fg        ansiColor
+	bg        ansiColor
+	bold      bool
+	faint     bool
+	italic    bool
+	underline bool
+	blink     bool
+	reverse   bool
+	strike    bool
+}
 
-# undo any 256 color marking
-s#${p}¬\([34]8;5;[0-9]\{1,3\}\)m#${p}\1m#g;
+// css renders the style as an inline CSS declaration. An empty string means the default style.
+func (s ansiStyle) css() string {
+	if s == (ansiStyle{}) {
+		return ""
+	}
+	css := make([]string, 0, 4)
+	fg, bg := "", ""
+	if s.fg.set {
+		fg = s.fg.hex(s.bold)
+	}
+	if s.bg.set {
+		bg = s.bg.hex(false)
+	}
+	if s.reverse {
+		if fg == "" {
+			fg = ansiDefaultFg
+		}
+		if bg == "" {
+			bg = ansiDefaultBg
+		}
+		fg, bg = bg, fg
+	}
+	if fg == "" && s.bold {
+		// Bold default text is bright white on a dark background
+		fg = ansiPalette[15]
+	}
+	if fg != "" {
+		css = append(css, "color:#"+fg)
+	}
+	if bg != "" {
+		css = append(css, "background-color:#"+bg)
+	}
+	if s.bold {
+		css = append(css, "font-weight:bold")
+	}
+	if s.faint {
+		css = append(css, "opacity:0.7")
+	}
+	if s.italic {
+		css = append(css, "font-style:italic")
+	}
+	decorations := make([]string, 0, 3)
+	if s.underline {
+		decorations = append(decorations, "underline")
+	}
+	if s.strike {
+		decorations = append(decorations, "line-through")
+	}
+	if s.blink {
+		decorations = append(decorations, "blink")
+	}
+	if len(decorations) != 0 {
+		css = append(css, "text-decoration:"+strings.Join(decorations, " "))
+	}
+	return strings.Join(css, ";")
+}
 
-# map 16 color codes to color + bold
-s#${p}9\([0-7]\)m#${p}3\1m${p}1m#g;
-s#${p}10\([0-7]\)m#${p}4\1m${p}1m#g;
+type ansiCell struct {
+	r     rune
+	style ansiStyle
+}
 
-# change 'reset' code to a single char, and prepend a single char to
-# other codes so that we can easily do negative matching, as sed
-# does not support look behind expressions etc.
-s#°#\&deg;#g; s#${p}0m#°#g
-s#¡#\&iexcl;#g; s#${p}[0-9;]*m#¡&#g
-" |
+// ANSIConverter is a streaming ANSI to HTML converter. Write raw console output to it and it will write
+// HTML to the underlying writer one line at a time. Because carriage-returns and erase-line codes can
+// rewrite a line, output for a line is only produced once the line is complete. Call Flush to emit any
+// trailing partial line.
+type ANSIConverter struct {
+	out     io.Writer
+	style   ansiStyle
+	line    []ansiCell
+	col     int
+	pending []byte // Incomplete escape sequence or UTF-8 character carried over between writes
+}
 
-# Convert SGR sequences to HTML
-sed "
-:ansi_to_span # replace ANSI codes with CSS classes
-t ansi_to_span # hack so t commands below only apply to preceeding s cmd
+// NewANSIConverter creates a converter that writes HTML to w
+func NewANSIConverter(w io.Writer) *ANSIConverter {
+	return &ANSIConverter{out: w}
+}
 
-/^[^¡]*°/ { b span_end } # replace 'reset code' if no preceeding code
+// Write converts p, writing any lines it completes to the underlying writer
+func (c *ANSIConverter) Write(p []byte) (int, error) {
+	err := c.convert(append(c.pending, p...), false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
 
-# common combinations to minimise html (optional)
-s#${P}3\([0-7]\)m¡${p}4\([0-7]\)m#\1<span class=\"f\2 b\3\">#;t span_count
-s#${P}4\([0-7]\)m¡${p}3\([0-7]\)m#\1<span class=\"f\3 b\2\">#;t span_count
+// Flush writes out any incomplete line that has been buffered, along with any incomplete escape sequence or
+// UTF-8 character as text
+func (c *ANSIConverter) Flush() error {
+	err := c.convert(c.pending, true)
+	if err != nil {
+		return err
+	}
+	if len(c.line) == 0 {
+		return nil
+	}
+	return c.emit(false)
+}
 
-s#${P}1m#\1<span class=\"bold\">#;                            t span_count
-s#${P}4m#\1<span class=\"underline\">#;                       t span_count
-s#${P}5m#\1<span class=\"blink\">#;                           t span_count
-s#${P}7m#\1<span class=\"reverse\">#;                         t span_count
-s#${P}9m#\1<span class=\"line-through\">#;                    t span_count
-s#${P}3\([0-9]\)m#\1<span class=\"f\2\">#;                    t span_count
-s#${P}4\([0-9]\)m#\1<span class=\"b\2\">#;                    t span_count
+// convert converts buf. Unless final is set, an incomplete escape sequence or UTF-8 character at the end of buf
+// is kept for the next write.
+func (c *ANSIConverter) convert(buf []byte, final bool) error {
+	c.pending = nil
+
+	i := 0
+	for i < len(buf) {
+		b := buf[i]
+		switch {
+		case b == 0x1b:
+			n, complete := c.escape(buf[i:])
+			if !complete {
+				if !final && len(buf)-i < ansiMaxSequence {
+					c.pending = append([]byte{}, buf[i:]...)
+					return nil
+				}
+				// Give up on the sequence, and show what follows the escape as text
+				n = 1
+			}
+			i += n
+			continue
+		case b == '\n':
+			err := c.emit(true)
+			if err != nil {
+				return err
+			}
+		case b == '\r':
+			c.col = 0
+		case b == '\b':
+			if c.col > 0 {
+				c.col--
+			}
+		case b == '\t':
+			c.put('\t')
+		case b < 0x20 || b == 0x7f:
+			// Strip other control characters (bells etc.)
+		case b < utf8.RuneSelf:
+			c.put(rune(b))
+		default:
+			if !utf8.FullRune(buf[i:]) && !final {
+				c.pending = append([]byte{}, buf[i:]...)
+				return nil
+			}
+			r, n := utf8.DecodeRune(buf[i:])
+			c.put(r)
+			i += n
+			continue
+		}
+		i++
+	}
+	return nil
+}
 
-s#${P}38;5;\([0-9]\{1,3\}\)m#\1<span class=\"ef\2\">#;        t span_count
-s#${P}48;5;\([0-9]\{1,3\}\)m#\1<span class=\"eb\2\">#;        t span_count
+// put writes a character at the cursor, overwriting anything already there
+func (c *ANSIConverter) put(r rune) {
+	for len(c.line) < c.col {
+		c.line = append(c.line, ansiCell{r: ' '})
+	}
+	cell := ansiCell{r: r, style: c.style}
+	if c.col == len(c.line) {
+		c.line = append(c.line, cell)
+	} else {
+		c.line[c.col] = cell
+	}
+	c.col++
+}
 
-s#${P}[0-9;]*m#\1#g; t ansi_to_span # strip unhandled codes
+// emit renders the current line as HTML and starts a new one
+func (c *ANSIConverter) emit(newline bool) error {
+	var out bytes.Buffer
+	var current ansiStyle
+	open := false
+	for _, cell := range c.line {
+		if !open || cell.style != current {
+			if open {
+				out.WriteString("</span>")
+				open = false
+			}
+			current = cell.style
+			if css := current.css(); css != "" {
+				out.WriteString("<span style='" + css + "'>")
+				open = true
+			}
+		}
+		out.WriteString(html.EscapeString(string(cell.r)))
+	}
+	if open {
+		out.WriteString("</span>")
+	}
+	if newline {
+		out.WriteByte('\n')
+	}
+	c.line = c.line[:0]
+	c.col = 0
+	_, err := c.out.Write(out.Bytes())
+	return err
+}
 
-b # next line of input
+// ansiMaxSequence is the longest an escape sequence can be. Without a limit a sequence that is never terminated
+// would have the rest of the log held back, and scanned again on every write.
+const ansiMaxSequence = 4096
 
-# add a corresponding span end flag
-:span_count
-x; s/^/s/; x
-b ansi_to_span
+// escape handles the escape sequence at the start of buf. It returns the number of bytes consumed and
+// whether the sequence was complete. Sequences we don't understand are stripped.
+func (c *ANSIConverter) escape(buf []byte) (int, bool) {
+	if len(buf) < 2 {
+		return 0, false
+	}
+	switch buf[1] {
+	case '[': // CSI
+		for i := 2; i < len(buf) && i < ansiMaxSequence; i++ {
+			if buf[i] >= 0x40 && buf[i] <= 0x7e {
+				c.csi(string(buf[2:i]), buf[i])
+				return i + 1, true
+			}
+		}
+		return 0, false
+	case ']', 'P', '_', '^': // OSC, DCS, APC and PM strings, terminated by BEL or ST
+		for i := 2; i < len(buf) && i < ansiMaxSequence; i++ {
+			if buf[i] == 0x07 {
+				return i + 1, true
+			}
+			if buf[i] == 0x1b && i+1 < len(buf) && buf[i+1] == '\\' {
+				return i + 2, true
+			}
+		}
+		return 0, false
+	case '(', ')', '*', '+': // Character set selection
+		if len(buf) < 3 {
+			return 0, false
+		}
+		return 3, true
+	default:
+		return 2, true
+	}
+}
 
-# replace 'reset code' with correct number of </span> tags
-:span_end
-x
-/^s/ {
-  s/^.//
-  x
-  s#°#</span>°#
-  b span_end
+// csi handles a control sequence with the given parameters and final byte
+func (c *ANSIConverter) csi(params string, final byte) {
+	switch final {
+	case 'm':
+		c.sgr(params)
+	case 'K':
+		switch params {
+		case "", "0": // Erase from cursor to end of line
+			if c.col < len(c.line) {
+				c.line = c.line[:c.col]
+			}
+		case "1": // Erase from start of line to cursor
+			for i := 0; i < c.col && i < len(c.line); i++ {
+				c.line[i] = ansiCell{r: ' '}
+			}
+		case "2": // Erase whole line
+			c.line = c.line[:0]
+		}
+	case 'G': // Cursor to column
+		c.moveTo(ansiParam(params, 1) - 1)
+	case 'C': // Cursor forward
+		c.moveTo(c.col + ansiParam(params, 1))
+	case 'D': // Cursor back
+		c.col -= ansiParam(params, 1)
+		if c.col < 0 {
+			c.col = 0
+		}
+	}
 }
-x
-s#°##
-b ansi_to_span
-" |
 
-# Convert alternative character set
-# Note we convert here, as if we do at start we have to worry about avoiding
-# conversion of SGR codes etc., whereas doing here we only have to
-# avoid conversions of stuff between &...; or <...>
-#
-# Note we could use sed to do this based around:
-#   sed 'y/abcdefghijklmnopqrstuvwxyz{}` + "`" + `~/▒␉␌␍␊°±␤␋┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π£◆·/'
-# However that would be very awkward as we need to only conv some input.
-# The basic scheme that we do in the python script below is:
-#  1. enable transliterate once ¡ char seen
-#  2. disable once µ char seen (may be on diff line to ¡)
-#  3. never transliterate between &; or <> chars
-sed "
-# change 'smacs' and 'rmacs' to a single char so that we can easily do
-# negative matching, as sed does not support look behind expressions etc.
-# Note we don't use ° like above as that's part of the alternate charset.
-s#\x1b(0#¡#g;
-s#µ#\&micro;#g; s#\x1b(B#µ#g
-" |
-(
-python -c "
-# vim:fileencoding=utf8
+// ansiMaxColumn is as far past the end of the line as the cursor can be moved. Without a limit a single escape
+// sequence in a build log could have the line padded with any number of spaces.
+const ansiMaxColumn = 4096
 
-import sys
-import locale
-encoding=locale.getpreferredencoding()
+// moveTo moves the cursor forward to a column, no further than ansiMaxColumn or the end of the line
+func (c *ANSIConverter) moveTo(col int) {
+	limit := ansiMaxColumn
+	if len(c.line) > limit {
+		limit = len(c.line)
+	}
+	if col > limit {
+		col = limit
+	}
+	c.col = col
+}
 
-old='abcdefghijklmnopqrstuvwxyz{}\` + "`" + `~'
-new='▒␉␌␍␊°±␤␋┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π£◆·'
-new=unicode(new, 'utf-8')
-table=range(128)
-for o,n in zip(old, new): table[ord(o)]=n
+// ansiParam parses a single numeric parameter, returning def if it is missing or invalid
+func ansiParam(params string, def int) int {
+	n, err := strconv.Atoi(params)
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
 
-(STANDARD, ALTERNATIVE, HTML_TAG, HTML_ENTITY) = (0, 1, 2, 3)
+// sgr applies a Select Graphic Rendition sequence to the current style
+func (c *ANSIConverter) sgr(params string) {
+	codes := strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' })
+	if len(codes) == 0 {
+		codes = []string{"0"}
+	}
+	nums := make([]int, len(codes))
+	for i, code := range codes {
+		nums[i], _ = strconv.Atoi(code)
+	}
 
-state = STANDARD
-last_mode = STANDARD
-for c in unicode(sys.stdin.read(), encoding):
-  if state == HTML_TAG:
-    if c == '>':
-      state = last_mode
-  elif state == HTML_ENTITY:
-    if c == ';':
-      state = last_mode
-  else:
-    if c == '<':
-      state = HTML_TAG
-    elif c == '&':
-      state = HTML_ENTITY
-    elif c == u'¡':
-      if state == STANDARD:
-        state = ALTERNATIVE
-        last_mode = ALTERNATIVE
-      continue
-    elif c == u'µ':
-      if state == ALTERNATIVE:
-        state = STANDARD
-        last_mode = STANDARD
-      continue
-    elif state == ALTERNATIVE:
-      c = c.translate(table)
-  sys.stdout.write(c.encode(encoding))
-" 2>/dev/null ||
-sed 's/[¡µ]//g' # just strip aternative flag chars
-)
+	for i := 0; i < len(nums); i++ {
+		n := nums[i]
+		switch {
+		case n == 0:
+			c.style = ansiStyle{}
+		case n == 1:
+			c.style.bold = true
+		case n == 2:
+			c.style.faint = true
+		case n == 3:
+			c.style.italic = true
+		case n == 4:
+			c.style.underline = true
+		case n == 5 || n == 6:
+			c.style.blink = true
+		case n == 7:
+			c.style.reverse = true
+		case n == 9:
+			c.style.strike = true
+		case n == 21 || n == 22:
+			c.style.bold = false
+			c.style.faint = false
+		case n == 23:
+			c.style.italic = false
+		case n == 24:
+			c.style.underline = false
+		case n == 25:
+			c.style.blink = false
+		case n == 27:
+			c.style.reverse = false
+		case n == 29:
+			c.style.strike = false
+		case n >= 30 && n <= 37:
+			c.style.fg = ansiColor{set: true, index: n - 30}
+		case n == 38 || n == 48:
+			color, consumed := ansiExtendedColor(nums[i+1:])
+			i += consumed
+			if n == 38 {
+				c.style.fg = color
+			} else {
+				c.style.bg = color
+			}
+		case n == 39:
+			c.style.fg = ansiColor{}
+		case n >= 40 && n <= 47:
+			c.style.bg = ansiColor{set: true, index: n - 40}
+		case n == 49:
+			c.style.bg = ansiColor{}
+		case n >= 90 && n <= 97:
+			c.style.fg = ansiColor{set: true, index: n - 90 + 8}
+		case n >= 100 && n <= 107:
+			c.style.bg = ansiColor{set: true, index: n - 100 + 8}
+		}
+	}
+}
 
-printf '</pre></div>
-\n'
-`
+// ansiExtendedColor parses the arguments to a 38 or 48 SGR code (256 colour or truecolor).
+// It returns the colour and the number of arguments consumed.
+func ansiExtendedColor(args []int) (ansiColor, int) {
+	if len(args) == 0 {
+		return ansiColor{}, 0
+	}
+	switch args[0] {
+	case 5:
+		if len(args) < 2 || args[1] < 0 || args[1] > 255 {
+			return ansiColor{}, len(args)
+		}
+		return ansiColor{set: true, index: args[1]}, 2
+	case 2:
+		if len(args) < 4 {
+			return ansiColor{}, len(args)
+		}
+		clamp := func(v int) int {
+			if v < 0 {
+				return 0
+			}
+			if v > 255 {
+				return 255
+			}
+			return v
+		}
+		return ansiColor{set: true, rgb: true, r: clamp(args[1]), g: clamp(args[2]), b: clamp(args[3])}, 4
+	default:
+		return ansiColor{}, 1
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestANSIConverter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string // Written one at a time, before a Flush
+		want   string
+	}{
+		{"plain", []string{"hello\n"}, "hello\n"},
+		{"html escaping", []string{"<a & b>\n"}, "&lt;a &amp; b&gt;\n"},
+		{"16 colours", []string{"\x1b[31mred\x1b[0m plain\n"}, "<span style='color:#AA0000'>red</span> plain\n"},
+		{"bright foreground", []string{"\x1b[91mx\n"}, "<span style='color:#FF5555'>x</span>\n"},
+		{"bright background", []string{"\x1b[102mx\n"}, "<span style='background-color:#55FF55'>x</span>\n"},
+		{"bold colour is bright", []string{"\x1b[1;31mx\n"}, "<span style='color:#FF5555;font-weight:bold'>x</span>\n"},
+		{"bold", []string{"\x1b[1mx\x1b[22my\n"}, "<span style='color:#FFFFFF;font-weight:bold'>x</span>y\n"},
+		{"underline", []string{"\x1b[4mx\x1b[24my\n"}, "<span style='text-decoration:underline'>x</span>y\n"},
+		{"reverse", []string{"\x1b[7mx\n"}, "<span style='color:#000000;background-color:#AAAAAA'>x</span>\n"},
+		{"reverse colours", []string{"\x1b[31;44;7mx\n"}, "<span style='color:#0000AA;background-color:#AA0000'>x</span>\n"},
+		{"256 colour palette", []string{"\x1b[38;5;9mx\n"}, "<span style='color:#FF5555'>x</span>\n"},
+		{"256 colour cube", []string{"\x1b[38;5;196mx\n"}, "<span style='color:#FF0000'>x</span>\n"},
+		{"256 colour greyscale", []string{"\x1b[48;5;232mx\n"}, "<span style='background-color:#080808'>x</span>\n"},
+		{"truecolor", []string{"\x1b[38;2;1;2;255mx\n"}, "<span style='color:#0102FF'>x</span>\n"},
+		{"truecolor with colons", []string{"\x1b[48:2:16:32:48mx\n"}, "<span style='background-color:#102030'>x</span>\n"},
+		{"progress bar", []string{"10%\r50%\r100%\n"}, "100%\n"},
+		{"carriage return overwrites", []string{"downloading\rdone\n"}, "doneloading\n"},
+		{"progress bar across writes", []string{"10%\r", "50%\r", "100%\n"}, "100%\n"},
+		{"erase to end of line", []string{"abcdef\r\x1b[2Cx\x1b[K\n"}, "abx\n"},
+		{"erase to start of line", []string{"abcdef\x1b[3D\x1b[1K\n"}, "   def\n"},
+		{"erase line", []string{"abc\x1b[2Kdef\n"}, "   def\n"},
+		{"erase line after carriage return", []string{"abc\r\x1b[2Kdef\n"}, "def\n"},
+		{"escape split across writes", []string{"\x1b[3", "2mg\n"}, "<span style='color:#00AA00'>g</span>\n"},
+		{"escape split after ESC", []string{"a\x1b", "[1mb\n"}, "a<span style='color:#FFFFFF;font-weight:bold'>b</span>\n"},
+		{"rune split across writes", []string{"\xe2\x82", "\xac\n"}, "\u20ac\n"},
+		{"OSC stripped", []string{"\x1b]0;title\x07ok\x1b]8;;\x1b\\\n"}, "ok\n"},
+		{"OSC split across writes", []string{"\x1b]0;ti", "tle\x1b", "\\ok\n"}, "ok\n"},
+		{"unterminated OSC", []string{"a\x1b]0;title"}, "a]0;title"},
+		{"unterminated OSC is given up on", []string{"a\x1b]0;", strings.Repeat("x", ansiMaxSequence), "\n"}, "a]0;" + strings.Repeat("x", ansiMaxSequence) + "\n"},
+		{"partial line", []string{"no newline"}, "no newline"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		c := NewANSIConverter(&out)
+		for _, w := range test.writes {
+			n, err := c.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("%s: wrote %d of %d bytes: %v", test.name, n, len(w), err)
+			}
+		}
+		err := c.Flush()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
+
+func TestANSI2HTMLCursorLimit(t *testing.T) {
+	var out bytes.Buffer
+	err := ANSI2HTML(&out, strings.NewReader("x\x1b[200000000Gy\nz\x1b[200000000Cw\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > 2*ansiMaxColumn+100 {
+		t.Fatalf("output is %d bytes, the cursor should stop at column %d", out.Len(), ansiMaxColumn)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	for i, want := range []string{"x", "z"} {
+		if !strings.HasPrefix(lines[i], want) || len(lines[i]) != ansiMaxColumn+1 {
+			t.Errorf("line %d is %d bytes starting %q", i+1, len(lines[i]), lines[i][:1])
+		}
+	}
+}
+
+func TestANSI2HTMLUnterminatedString(t *testing.T) {
+	var out bytes.Buffer
+	c := NewANSIConverter(&out)
+	c.Write([]byte("a\x1b]0;title\n"))
+	for i := 0; i < 1000; i++ {
+		c.Write([]byte("line\n"))
+	}
+	if len(c.pending) >= ansiMaxSequence {
+		t.Fatalf("%d bytes are held back", len(c.pending))
+	}
+	err := c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out.String(), "line\n"); got != 1000 {
+		t.Errorf("only %d of 1000 lines following the unterminated sequence were written", got)
+	}
+
+	// Flush writes out what it is holding back
+	out.Reset()
+	c = NewANSIConverter(&out)
+	c.Write([]byte("b\x1b]0;title"))
+	c.Flush()
+	if out.String() != "b]0;title" {
+		t.Errorf("flushed %q", out.String())
+	}
+}
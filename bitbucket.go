@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/phayes/hookserve/hookserve"
+)
+
+// BitbucketServer receives Bitbucket Cloud and Bitbucket Server push and pull request webhooks.
+// It is the Bitbucket counterpart of hookserve.Server and passes events to BitbucketServer.Events in the same form.
+type BitbucketServer struct {
+	Secret string            // Optional secret key for authenticating via HMAC
+	Events chan WebhookEvent // Channel of events. Read from this channel to get events as they happen.
+}
+
+// NewBitbucketServer creates a new Bitbucket webhook receiver
+func NewBitbucketServer() *BitbucketServer {
+	return &BitbucketServer{
+		Events: make(chan WebhookEvent, 10), // buffered to 10 items
+	}
+}
+
+// Bitbucket Cloud payloads
+
+type bitbucketCloudRepository struct {
+	FullName string `json:"full_name"`
+}
+
+type bitbucketCloudPush struct {
+	Push struct {
+		Changes []struct {
+			New *struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Target struct {
+					Hash    string `json:"hash"`
+					Message string `json:"message"`
+				} `json:"target"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+	Repository bitbucketCloudRepository `json:"repository"`
+}
+
+type bitbucketCloudEndpoint struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Repository bitbucketCloudRepository `json:"repository"`
+}
+
+type bitbucketCloudPullRequest struct {
+	PullRequest struct {
+		Source      bitbucketCloudEndpoint `json:"source"`
+		Destination bitbucketCloudEndpoint `json:"destination"`
+	} `json:"pullrequest"`
+}
+
+// Bitbucket Server payloads
+
+type bitbucketServerRepository struct {
+	Slug    string `json:"slug"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+}
+
+type bitbucketServerRefsChanged struct {
+	Changes []struct {
+		Ref struct {
+			ID        string `json:"id"`
+			DisplayID string `json:"displayId"`
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+	Repository bitbucketServerRepository `json:"repository"`
+}
+
+type bitbucketServerRef struct {
+	DisplayID    string                    `json:"displayId"`
+	LatestCommit string                    `json:"latestCommit"`
+	Repository   bitbucketServerRepository `json:"repository"`
+}
+
+type bitbucketServerPullRequest struct {
+	PullRequest struct {
+		FromRef bitbucketServerRef `json:"fromRef"`
+		ToRef   bitbucketServerRef `json:"toRef"`
+	} `json:"pullRequest"`
+}
+
+// Actions on pull requests, translated into their GitHub equivalents. Bitbucket Cloud sends pullrequest:updated
+// for edits to the title or description as well as for new commits, so it is passed on as "updated" for
+// QueueEvent to tell which it is.
+var bitbucketActions = map[string]string{
+	"pullrequest:created":   "opened",
+	"pullrequest:updated":   "updated",
+	"pr:opened":             "opened",
+	"pr:from_ref_updated":   "synchronize",
+	"pullrequest:fulfilled": "closed",
+	"pullrequest:rejected":  "closed",
+	"pr:merged":             "closed",
+	"pr:declined":           "closed",
+}
+
+// Satisfies the http.Handler interface
+func (s *BitbucketServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if req.Method != "POST" {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventKey := req.Header.Get("X-Event-Key")
+	if eventKey == "" {
+		http.Error(w, "400 Bad Request - Missing X-Event-Key Header", http.StatusBadRequest)
+		return
+	}
+	if eventKey == "diagnostics:ping" {
+		// Bitbucket Server's "Test connection" button
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If we have a Secret set, we should check the MAC
+	if s.Secret != "" {
+		sig := req.Header.Get("X-Hub-Signature")
+		if sig == "" {
+			http.Error(w, "403 Forbidden - Missing X-Hub-Signature required for HMAC verification", http.StatusForbidden)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write(body)
+		expectedSig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expectedSig), []byte(sig)) {
+			http.Error(w, "403 Forbidden - HMAC verification failed", http.StatusForbidden)
+			return
+		}
+	}
+
+	events := []WebhookEvent{}
+	switch eventKey {
+	case "repo:push": // Cloud
+		hook := bitbucketCloudPush{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		owner, repo, err := splitProjectPath(hook.Repository.FullName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, change := range hook.Push.Changes {
+			// Skip deleted branches and tags
+			if change.New == nil || change.New.Type != "branch" {
+				continue
+			}
+			events = append(events, WebhookEvent{
+				Event: hookserve.Event{
+					Type:   "push",
+					Owner:  owner,
+					Repo:   repo,
+					Branch: change.New.Name,
+					Commit: change.New.Target.Hash,
+				},
+				Message: change.New.Target.Message,
+			})
+		}
+	case "repo:refs_changed": // Server
+		hook := bitbucketServerRefsChanged{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, change := range hook.Changes {
+			// Skip deleted branches and tags
+			if change.Type == "DELETE" || !strings.HasPrefix(change.Ref.ID, "refs/heads/") {
+				continue
+			}
+			events = append(events, WebhookEvent{Event: hookserve.Event{
+				Type:   "push",
+				Owner:  hook.Repository.Project.Key,
+				Repo:   hook.Repository.Slug,
+				Branch: change.Ref.DisplayID,
+				Commit: change.ToHash,
+			}})
+		}
+	case "pullrequest:created", "pullrequest:updated", "pullrequest:fulfilled", "pullrequest:rejected": // Cloud
+		hook := bitbucketCloudPullRequest{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr := hook.PullRequest
+		event := hookserve.Event{
+			Type:       "pull_request",
+			Action:     bitbucketActions[eventKey],
+			Branch:     pr.Source.Branch.Name,
+			Commit:     pr.Source.Commit.Hash,
+			BaseBranch: pr.Destination.Branch.Name,
+		}
+		event.Owner, event.Repo, err = splitProjectPath(pr.Source.Repository.FullName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		event.BaseOwner, event.BaseRepo, err = splitProjectPath(pr.Destination.Repository.FullName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, WebhookEvent{Event: event})
+	case "pr:opened", "pr:from_ref_updated", "pr:merged", "pr:declined": // Server
+		hook := bitbucketServerPullRequest{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr := hook.PullRequest
+		events = append(events, WebhookEvent{Event: hookserve.Event{
+			Type:       "pull_request",
+			Action:     bitbucketActions[eventKey],
+			Owner:      pr.FromRef.Repository.Project.Key,
+			Repo:       pr.FromRef.Repository.Slug,
+			Branch:     pr.FromRef.DisplayID,
+			Commit:     pr.FromRef.LatestCommit,
+			BaseOwner:  pr.ToRef.Repository.Project.Key,
+			BaseRepo:   pr.ToRef.Repository.Slug,
+			BaseBranch: pr.ToRef.DisplayID,
+		}})
+	default:
+		http.Error(w, "400 Bad Request - Unknown Event Type "+eventKey, http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range events {
+		if event.Owner == "" || event.Repo == "" || event.Commit == "" {
+			http.Error(w, "400 Bad Request - Incomplete "+eventKey+" payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// We've built our Events - put them into the channel and we're done
+	go func() {
+		for _, event := range events {
+			s.Events <- event
+		}
+	}()
+
+	for _, event := range events {
+		w.Write([]byte(event.String()))
+	}
+}
+
+// bitbucketProvider builds repositories hosted on Bitbucket Cloud or a Bitbucket Server
+type bitbucketProvider struct {
+	config   *BitbucketConfig
+	receiver *BitbucketServer
+}
+
+// NewBitbucketProvider creates the Bitbucket provider from the [bitbucket] section of the config
+func NewBitbucketProvider() Provider {
+	receiver := NewBitbucketServer()
+	receiver.Secret = Config.Bitbucket.Secret
+	return &bitbucketProvider{config: &Config.Bitbucket, receiver: receiver}
+}
+
+var bitbucketStatuses = statusMap{
+	StatusPending:    "INPROGRESS",
+	StatusRunning:    "INPROGRESS",
+	StatusSuccess:    "SUCCESSFUL",
+	StatusFailed:     "FAILED",
+	StatusFailedBoot: "FAILED",
+	StatusCancelled:  "STOPPED",
+	StatusTimedOut:   "FAILED",
+	StatusSuperseded: "STOPPED",
+	StatusSkipped:    "INPROGRESS", // Bitbucket has no neutral state, and a skipped build must not pass merge checks
+}
+
+func (p *bitbucketProvider) Name() string   { return "Bitbucket" }
+func (p *bitbucketProvider) Domain() string { return p.config.Domain }
+
+func (p *bitbucketProvider) Webhook() (string, http.Handler) { return "/bitbucket", p.receiver }
+func (p *bitbucketProvider) Events() <-chan WebhookEvent     { return p.receiver.Events }
+
+func (p *bitbucketProvider) CloneURL(e *Event) string {
+	if p.config.Server {
+		// Bitbucket Server serves repositories under /scm, and ssh on port 7999 by default
+		if Config.HttpsClone {
+			return p.config.URL + "/scm/" + e.Owner + "/" + e.Repo + ".git"
+		}
+		return "ssh://git@" + strings.Split(e.Domain, ":")[0] + ":7999/" + e.Owner + "/" + e.Repo + ".git"
+	}
+	if Config.HttpsClone {
+		return p.config.URL + "/" + e.Owner + "/" + e.Repo + ".git"
+	}
+	return sshCloneURL(e)
+}
+
+func (p *bitbucketProvider) Checkout(e *Event, dir string) error {
+	return gitCheckout(e, p.CloneURL(e), dir)
+}
+
+func (p *bitbucketProvider) TranslateStatus(status string) string {
+	return bitbucketStatuses.Translate(status)
+}
+
+// Report posts the status of the event to the Bitbucket build status API
+func (p *bitbucketProvider) Report(e *Event) error {
+	// If bitbucket token is not set, skip posting results
+	if p.config.Token == "" {
+		return nil
+	}
+
+	status, err := json.Marshal(map[string]string{
+		"state":       e.TranslateStatus(),
+		"key":         "deadci",
+		"name":        "DeadCI",
+		"url":         e.FullURL(),
+		"description": e.StatusDescription(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Statuses are posted against the commit in the repository it was pushed to
+	var endpoint string
+	if p.config.Server {
+		endpoint = p.config.URL + "/rest/build-status/1.0/commits/" + e.Commit
+	} else {
+		endpoint = p.config.APIURL + "/repositories/" + e.Owner + "/" + e.Repo + "/commit/" + e.Commit + "/statuses/build"
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(status))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+p.config.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Bitbucket status update failed: " + resp.Status + " " + string(body))
+	}
+	return nil
+}
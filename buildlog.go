@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	logFlushInterval = 250 * time.Millisecond // Longest a line of output waits before being written to the log
+	logFlushSize     = 64 * 1024              // Amount of output that is written to the log straight away
+	logMaxLine       = 64 * 1024              // Longer lines are split into several records
+)
+
+// A logLine is a line of output from a build command
+type logLine struct {
+	Time   time.Time
+	Stream string // "stdout" or "stderr"
+	Text   []byte // Without the line ending
+}
+
+// Record formats the line as it appears in the log: timestamped and tagged with the stream it came from
+func (l logLine) Record() []byte {
+	record := make([]byte, 0, len(l.Text)+24)
+	record = append(record, '[')
+	record = l.Time.AppendFormat(record, "15:04:05.000")
+	record = append(record, ' ')
+	record = append(record, l.Stream...)
+	record = append(record, "] "...)
+	record = append(record, l.Text...)
+	return append(record, '\n')
+}
+
+// captureLines reads r line by line, sending each line on lines until r is exhausted
+func captureLines(r io.Reader, stream string, lines chan<- logLine) error {
+	reader := bufio.NewReaderSize(r, logMaxLine)
+	for {
+		text, _, err := reader.ReadLine()
+		if len(text) != 0 || err == nil {
+			lines <- logLine{Time: time.Now(), Stream: stream, Text: append([]byte{}, text...)}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// buildLog writes the output of a build into its event's log. Output is written out in batches
+// rather than line by line, and anything beyond the maximum log size is dropped.
+type buildLog struct {
+	event     *Event
+	size      int    // Size of the log, including output not yet written
+	unflushed []byte // Output not yet written
+	lastFlush time.Time
+	dropped   int // Bytes of output dropped since the log got too big
+}
+
+func newBuildLog(e *Event) (*buildLog, error) {
+	size, err := e.LogSize()
+	if err != nil {
+		return nil, err
+	}
+	return &buildLog{event: e, size: size, lastFlush: time.Now()}, nil
+}
+
+// Write adds a line of command output to the log
+func (l *buildLog) Write(line logLine) error {
+	return l.append(line.Record(), len(line.Text)+1)
+}
+
+// Print adds a message from DeadCI itself to the log
+func (l *buildLog) Print(msg string) error {
+	return l.append([]byte(msg), len(msg))
+}
+
+// append p to the log, or count size bytes of output as dropped if the log is full
+func (l *buildLog) append(p []byte, size int) error {
+	if l.dropped != 0 {
+		l.dropped += size
+		return nil
+	}
+	if Config.MaxLogSize != 0 && l.size+len(p) > Config.MaxLogSize {
+		l.dropped = size
+		l.unflushed = append(l.unflushed, "\n[log truncated: it has reached the limit of "+strconv.Itoa(Config.MaxLogSize)+" bytes, further output is dropped]\n"...)
+		return l.Flush()
+	}
+
+	l.unflushed = append(l.unflushed, p...)
+	l.size += len(p)
+	if len(l.unflushed) >= logFlushSize || time.Since(l.lastFlush) >= logFlushInterval {
+		return l.Flush()
+	}
+	return nil
+}
+
+// Tick writes output that has been waiting too long, for when the build has gone quiet
+func (l *buildLog) Tick() error {
+	if len(l.unflushed) != 0 && time.Since(l.lastFlush) >= logFlushInterval {
+		return l.Flush()
+	}
+	return nil
+}
+
+// Flush writes any output that hasn't been written yet
+func (l *buildLog) Flush() error {
+	l.lastFlush = time.Now()
+	if len(l.unflushed) == 0 {
+		return nil
+	}
+	err := l.event.AppendLog(l.unflushed)
+	l.unflushed = l.unflushed[:0]
+	return err
+}
+
+// Close notes how much output was dropped, if any, and writes out the rest of the log
+func (l *buildLog) Close() error {
+	if l.dropped != 0 {
+		l.unflushed = append(l.unflushed, "["+strconv.Itoa(l.dropped)+" bytes of output dropped]\n"...)
+	}
+	return l.Flush()
+}
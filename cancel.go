@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// RunningBuilds tracks the builds being run by this server so that they can be cancelled
+var RunningBuilds = &buildRegistry{builds: make(map[string]context.CancelCauseFunc)}
+
+// Reasons for stopping a build, keyed by the status the build ends up with
+var (
+	ErrCancelled  = errors.New("build cancelled")
+	ErrSuperseded = errors.New("build superseded by a newer commit")
+	stopReasons   = map[string]error{
+		StatusCancelled:  ErrCancelled,
+		StatusSuperseded: ErrSuperseded,
+	}
+)
+
+type buildRegistry struct {
+	sync.Mutex
+	builds map[string]context.CancelCauseFunc
+}
+
+// Start registers a build of the event, returning a context that is cancelled if the build is stopped
+func (b *buildRegistry) Start(e *Event) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	b.Lock()
+	b.builds[e.Path()] = cancel
+	b.Unlock()
+	return ctx
+}
+
+// Done unregisters the build of the event once it has finished
+func (b *buildRegistry) Done(e *Event) {
+	b.Lock()
+	if cancel, ok := b.builds[e.Path()]; ok {
+		cancel(nil)
+		delete(b.builds, e.Path())
+	}
+	b.Unlock()
+}
+
+// Cancel the build of the event for the given reason. Returns false if this server isn't running it.
+func (b *buildRegistry) Cancel(e *Event, reason error) bool {
+	return b.CancelPath(e.Path(), reason)
+}
+
+// CancelPath cancels the build of the event at the path for the given reason. Returns false if this server isn't
+// running it.
+func (b *buildRegistry) CancelPath(path string, reason error) bool {
+	b.Lock()
+	defer b.Unlock()
+	cancel, ok := b.builds[path]
+	if ok {
+		cancel(reason)
+	}
+	return ok
+}
+
+// stopBuild stops the build of the event at the path, if this server is running it, at the request of another
+// server sharing the database. That server has already given it the status.
+func stopBuild(path, status string) {
+	if reason, ok := stopReasons[status]; ok {
+		RunningBuilds.CancelPath(path, reason)
+	}
+}
+
+// stoppedElsewhere returns the status and reason for a build that another server stopped, or took on, as it was
+// being started here, or an empty status if the build is still ours
+func (e *Event) stoppedElsewhere() (string, error) {
+	current, err := GetEventByID(e.ID)
+	if err != nil {
+		log.Println(err)
+		return "", nil
+	}
+	if current == nil || current.RunNumber != e.RunNumber || current.Node != e.Node {
+		return StatusCancelled, ErrCancelled
+	}
+	if reason, ok := stopReasons[current.Status]; ok {
+		return current.Status, reason
+	}
+	return "", nil
+}
+
+// Cancel stops the event if it is pending or running. Cancelling a matrix event cancels all of its jobs.
+func (e *Event) Cancel() error {
+	return e.stop(StatusCancelled)
+}
+
+// Supersede stops the event if it is pending or running because a newer commit has been pushed
+func (e *Event) Supersede() error {
+	return e.stop(StatusSuperseded)
+}
+
+// stop a pending or running event, giving it the status
+func (e *Event) stop(status string) error {
+	if e.Job == 0 {
+		jobs, err := GetJobs(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit)
+		if err != nil {
+			return err
+		}
+		for i := range jobs {
+			err = jobs[i].stop(status)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	stopped, err := e.setStopped(status)
+	if err != nil || stopped == nil {
+		return err
+	}
+	return stopped.reportFinal()
+}
+
+// setStopped records the status on the event if it is still to be stopped here, returning it so that it can be
+// reported, or nil if there is nothing to report
+func (e *Event) setStopped(status string) (*Event, error) {
+	// The status is only recorded if nobody changes the event while we look, otherwise we look again
+	for {
+		current, err := GetJob(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit, e.Job)
+		if err != nil || current == nil || IsFinal(current.Status) {
+			return nil, err
+		}
+		if current.Status == StatusRunning && RunningBuilds.Cancel(current, stopReasons[status]) {
+			// The build stops itself and records the status
+			return nil, nil
+		}
+		if current.Status == StatusRunning && e.Job == 0 {
+			// A matrix event is finished off by its jobs
+			if jobs, err := GetJobs(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit); err != nil || len(jobs) != 0 {
+				return nil, err
+			}
+		}
+
+		var ok bool
+		if current.Status == StatusRunning && current.Node != Config.Database.Node {
+			// Another server is building it. The status is recorded here, so that it stands even if that server
+			// has gone, and that server is asked to stop the build and finish its log.
+			from := current.Status
+			current.Status = status
+			ok, err = DB.UpdateFrom(current, from)
+			if err == nil && ok {
+				err = DB.NotifyStop(current)
+			}
+		} else {
+			ok, err = current.setFinal(status, stopReasons[status])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return current, nil
+		}
+	}
+}
+
+// SupersedeEvents stops the builds of the commits on the event's branch that were queued before it
+func (e *Event) SupersedeEvents() error {
+	events, err := GetActiveEvents(e.Domain, e.Owner, e.Repo, e.Branch)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		// A late webhook for an old commit mustn't stop the builds of newer ones
+		if events[i].Commit == e.Commit || events[i].ID >= e.ID {
+			continue
+		}
+		err = events[i].Supersede()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel a pending or running item, then show it
+func handleCancel(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
+	if len(path) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+
+	event, err := GetJob(path[0], path[1], path[2], path[3], path[4], suffix.Job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if IsFinal(event.Status) {
+		http.Error(w, "Unable to cancel item that is not pending or running", http.StatusConflict)
+		return
+	}
+
+	err = event.Cancel()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/"+event.Path(), http.StatusSeeOther)
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dlintw/goconf"
 )
@@ -15,16 +23,101 @@ var Config struct {
 	IniFile string
 	TempDir string
 	Command []string
-	Port    int
-	Host    string
-	Github  struct {
+	Timeout time.Duration
+	// Stop building older commits of a branch when a newer one is pushed
+	AutoCancel bool
+	// Maximum size of a build log in bytes, 0 for no limit
+	MaxLogSize int
+	// Gzip the logs of finished builds
+	CompressLogs bool
+	Port         int
+	Host         string
+	Github       struct {
 		Enabled bool
 		Token   string
 		Secret  string
 	}
+	Gitlab    ServerConfig
+	Gitea     ServerConfig
+	Bitbucket BitbucketConfig
+	Poll      struct {
+		Interval time.Duration
+		Branches []string // Branch patterns to build, as understood by path.Match
+		Repos    []PollRepo
+	}
+	Local struct {
+		Enabled bool
+		Root    string // Directory under which bare repositories are stored as <owner>/<repo>
+	}
+	Docker struct {
+		Enabled bool
+		Runtime string // Container runtime binary, docker or a compatible one such as podman
+		Image   string // Default image to build in
+		Memory  string // Memory limit for build containers, for example "2g"
+		CPUs    string // Number of CPUs build containers may use, for example "1.5"
+	}
+	Sandbox struct {
+		Enabled bool
+		Network bool // Give builds access to the host network
+	}
+	// Number of workers in the default pool, which has no labels
+	Workers int
+	// Further pools of workers, each with their own labels
+	Pools []WorkerPool
+	// Maximum number of builds of one repository, and of all the repositories of one owner, to run at once.
+	// 0 for no limit.
+	MaxRepoBuilds  int
+	MaxOwnerBuilds int
+	// Settings for remote build agents connecting to this server
+	Agents struct {
+		Enabled bool
+		Secret  string        // Shared secret agents authenticate with
+		Timeout time.Duration // How long an agent may go without a heartbeat before its builds are requeued
+	}
+	// Settings for running as a remote build agent with `deadci agent`
+	Agent struct {
+		Coordinator string // Base URL of the DeadCI server to take builds from
+		Secret      string
+		Name        string
+		Labels      []string
+		Workers     int
+	}
+	// Labels a worker or agent must have to build a repository, keyed by label. Values are patterns of
+	// <domain>/<owner>/<repo>, as understood by path.Match.
+	Labels map[string][]string
+	// Branches built, and files whose changes trigger builds. See filter.go.
+	Branches Filter
+	Paths    Filter
+	// Priorities of events in the queue, highest first. Events no rule matches have priority 0.
+	Priorities []PriorityRule
+	// Priority given to builds re-run by hand, if higher than their rule's
+	RerunPriority int
+	Database      struct {
+		Driver  string        // sqlite3 or postgres
+		URL     string        // Path of the SQLite database, or a PostgreSQL connection string
+		Node    string        // Address the other servers sharing the database reach this one at. See nodes.go.
+		Timeout time.Duration // How long before the builds of a server that has gone quiet are queued again
+	}
 	HttpsClone bool
 }
 
+// ServerConfig holds the settings for a self-hosted source-control server
+type ServerConfig struct {
+	Enabled bool
+	URL     string // Base URL of the server, for example https://gitlab.example.com
+	Domain  string // Host part of URL, used as the domain of events
+	Token   string
+	Secret  string
+}
+
+// BitbucketConfig holds the settings for Bitbucket Cloud or a Bitbucket Server
+type BitbucketConfig struct {
+	ServerConfig
+	Server   bool   // Bitbucket Server (Data Center) rather than Bitbucket Cloud
+	Username string // Username for basic auth. If empty the token is sent as a bearer token.
+	APIURL   string // Base URL of the Bitbucket Cloud REST API
+}
+
 func init() {
 	flag.StringVar(&Config.DataDir, "data-dir", "", "Data directory where config is stored. Must be writable.")
 	flag.StringVar(&Config.IniFile, "config", "", "Direct path to deadci.ini if config is not stored in data directory.")
@@ -51,18 +144,96 @@ func InitConfig() {
 		log.Fatal(err.Error() + ". Please ensure that your deadci.ini file is readable and in place at " + Config.IniFile)
 	}
 
-	// Parse command
+	// Parse command. It may be left empty if all repositories provide a .deadci.yml
 	cmd, err := c.GetString("", "command")
-	if err != nil {
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
 		log.Fatal(err)
 	}
 	cmd = strings.Trim(cmd, " ")
 	if cmd == "" {
-		log.Fatal("Missing command in deadci.ini. Please specify a command to run to build / test your repositories.")
+		log.Println("No command specified in deadci.ini. Only repositories with a " + RepoConfigFile + " file will be built.")
+	} else {
+		Config.Command = strings.Split(cmd, " ")
+	}
+
+	// Parse the global build timeout
+	timeout, err := c.GetString("", "timeout")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if timeout != "" {
+		Config.Timeout, err = time.ParseDuration(timeout)
+		if err != nil || Config.Timeout <= 0 {
+			log.Fatal("Invalid timeout in deadci.ini. Please specify a duration such as 1h")
+		}
+	}
+
+	// Parse autocancel
+	Config.AutoCancel, err = c.GetBool("", "autocancel")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+
+	// Parse the maximum log size
+	maxLogSize, err := c.GetString("", "maxlogsize")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	Config.MaxLogSize = DefaultMaxLogSize
+	if maxLogSize != "" {
+		Config.MaxLogSize, err = ParseByteSize(maxLogSize)
+		if err != nil {
+			log.Fatal("Invalid maxlogsize in deadci.ini. Please specify a size such as 10M")
+		}
+	}
+
+	// Parse the number of workers and the limits on concurrent builds
+	Config.Workers = getCount(c, "", "workers", runtime.NumCPU())
+	Config.MaxRepoBuilds = getCount(c, "", "maxrepobuilds", 0)
+	Config.MaxOwnerBuilds = getCount(c, "", "maxownerbuilds", 0)
+	if c.HasSection("pools") {
+		parsePoolsConfig(c)
+	}
+
+	// Parse the filters deciding which pushes and pull requests are built
+	for option, list := range map[string]*[]string{
+		"branches":     &Config.Branches.Only,
+		"skipbranches": &Config.Branches.Except,
+		"paths":        &Config.Paths.Only,
+		"skippaths":    &Config.Paths.Except,
+	} {
+		patterns, err := c.GetString("", option)
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		*list = strings.Fields(patterns)
+	}
+	if err := Config.Branches.Validate(); err != nil {
+		log.Fatal("Invalid branches or skipbranches in deadci.ini: " + err.Error())
+	}
+	if err := Config.Paths.Validate(); err != nil {
+		log.Fatal("Invalid paths or skippaths in deadci.ini: " + err.Error())
+	}
+
+	// Parse the priorities of builds in the queue
+	rerunPriority, err := c.GetString("", "rerunpriority")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if rerunPriority = strings.TrimSpace(rerunPriority); rerunPriority != "" {
+		Config.RerunPriority, err = strconv.Atoi(rerunPriority)
+		if err != nil {
+			log.Fatal("Invalid rerunpriority in deadci.ini. Please specify a number")
+		}
 	}
-	Config.Command = strings.Split(cmd, " ")
-	if len(Config.Command) == 0 {
-		log.Fatal("Missing command in deadci.ini. Please specify a command to run to build / test your repositories.")
+	if c.HasSection("priorities") {
+		parsePrioritiesConfig(c)
+	}
+
+	// Parse compresslogs
+	Config.CompressLogs, err = c.GetBool("", "compresslogs")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
 	}
 
 	// Parse Port
@@ -110,6 +281,151 @@ func InitConfig() {
 		}
 	}
 
+	// Parse settings for self-hosted servers
+	parseServerConfig(c, "gitlab", "GitLab", &Config.Gitlab)
+	parseServerConfig(c, "gitea", "Gitea", &Config.Gitea)
+
+	// Parse Bitbucket settings. Bitbucket Cloud is assumed unless server is set.
+	if c.HasSection("bitbucket") {
+		Config.Bitbucket.Server, err = c.GetBool("bitbucket", "server")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		if !Config.Bitbucket.Server {
+			Config.Bitbucket.URL = "https://bitbucket.org"
+		}
+		parseServerConfig(c, "bitbucket", "Bitbucket", &Config.Bitbucket.ServerConfig)
+		Config.Bitbucket.Username, err = c.GetString("bitbucket", "username")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		Config.Bitbucket.APIURL, err = c.GetString("bitbucket", "apiurl")
+		if (err != nil && err.(goconf.GetError).Reason == goconf.OptionNotFound) || Config.Bitbucket.APIURL == "" {
+			Config.Bitbucket.APIURL = "https://api.bitbucket.org/2.0"
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		Config.Bitbucket.APIURL = strings.TrimRight(Config.Bitbucket.APIURL, "/ ")
+	}
+
+	// Parse polled repositories
+	if c.HasSection("poll") {
+		parsePollConfig(c)
+	}
+
+	// Parse local repository settings
+	if c.HasSection("local") {
+		Config.Local.Enabled, err = c.GetBool("local", "enabled")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		if Config.Local.Enabled {
+			Config.Local.Root, err = c.GetString("local", "root")
+			if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+				log.Fatal(err)
+			}
+			if Config.Local.Root == "" {
+				log.Fatal("Missing root in [local] section of deadci.ini. Please specify the directory your bare repositories are stored in.")
+			}
+			Config.Local.Root, err = filepath.Abs(Config.Local.Root)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Parse container settings
+	if c.HasSection("docker") {
+		Config.Docker.Enabled, err = c.GetBool("docker", "enabled")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		for option, value := range map[string]*string{
+			"runtime": &Config.Docker.Runtime,
+			"image":   &Config.Docker.Image,
+			"memory":  &Config.Docker.Memory,
+			"cpus":    &Config.Docker.CPUs,
+		} {
+			*value, err = c.GetString("docker", option)
+			if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+				log.Fatal(err)
+			}
+			*value = strings.TrimSpace(*value)
+		}
+		if Config.Docker.Runtime == "" {
+			Config.Docker.Runtime = "docker"
+		}
+	}
+
+	// Parse sandbox settings
+	if c.HasSection("sandbox") {
+		Config.Sandbox.Enabled, err = c.GetBool("sandbox", "enabled")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		Config.Sandbox.Network, err = c.GetBool("sandbox", "network")
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		if Config.Sandbox.Enabled && Config.Docker.Enabled {
+			log.Fatal("Only one of the [docker] and [sandbox] sections of deadci.ini may be enabled")
+		}
+	}
+
+	// Parse agent settings
+	if c.HasSection("agents") {
+		parseAgentsConfig(c)
+	}
+	if c.HasSection("agent") {
+		parseAgentConfig(c)
+	}
+	if c.HasSection("labels") {
+		parseLabelsConfig(c)
+	}
+
+	// Parse database settings. Builds are kept in SQLite in the data dir unless told otherwise.
+	Config.Database.Driver = "sqlite3"
+	Config.Database.Timeout = time.Minute
+	nodeTimeout := ""
+	if c.HasSection("database") {
+		for option, value := range map[string]*string{
+			"driver":  &Config.Database.Driver,
+			"url":     &Config.Database.URL,
+			"node":    &Config.Database.Node,
+			"timeout": &nodeTimeout,
+		} {
+			*value, err = c.GetString("database", option)
+			if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+				log.Fatal(err)
+			}
+			*value = strings.TrimSpace(*value)
+		}
+		switch Config.Database.Driver {
+		case "", "sqlite", "sqlite3":
+			Config.Database.Driver = "sqlite3"
+		case "postgres", "postgresql":
+			Config.Database.Driver = "postgres"
+			if Config.Database.URL == "" {
+				log.Fatal("Missing url in [database] section of deadci.ini. Please specify a connection string such as postgres://deadci@localhost/deadci")
+			}
+		default:
+			log.Fatal("Invalid driver in [database] section of deadci.ini. Please specify sqlite3 or postgres")
+		}
+	}
+	if Config.Database.Node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		Config.Database.Node = hostname + ":" + strconv.Itoa(Config.Port)
+	}
+	if nodeTimeout != "" {
+		Config.Database.Timeout, err = time.ParseDuration(nodeTimeout)
+		if err != nil || Config.Database.Timeout < 2*nodeHeartbeatInterval {
+			log.Fatal("Invalid timeout in [database] section of deadci.ini. Please specify a duration of at least " + (2 * nodeHeartbeatInterval).String())
+		}
+	}
+
 	// Parse clone style (git or https)
 	Config.HttpsClone, err = c.GetBool("", "httpsclone")
 	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
@@ -117,3 +433,283 @@ func InitConfig() {
 	}
 
 }
+
+// parseServerConfig reads the settings for a self-hosted server from the given section of deadci.ini
+func parseServerConfig(c *goconf.ConfigFile, section, name string, sc *ServerConfig) {
+	if !c.HasSection(section) {
+		return
+	}
+	var err error
+	sc.Enabled, err = c.GetBool(section, "enabled")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if !sc.Enabled {
+		return
+	}
+	// A URL set before parsing is the default for the section
+	serverURLStr, err := c.GetString(section, "url")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if serverURLStr != "" {
+		sc.URL = serverURLStr
+	}
+	sc.URL = strings.TrimRight(sc.URL, "/ ")
+	serverURL, err := url.Parse(sc.URL)
+	if err != nil || serverURL.Host == "" {
+		log.Fatal("Invalid or missing url in [" + section + "] section of deadci.ini. Please specify the URL of your " + name + " server, for example https://" + section + ".example.com")
+	}
+	sc.Domain = serverURL.Host
+	sc.Token, err = c.GetString(section, "token")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	sc.Secret, err = c.GetString(section, "secret")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+}
+
+// parsePollConfig reads the repositories to poll from the [poll] section of deadci.ini
+func parsePollConfig(c *goconf.ConfigFile) {
+	enabled, err := c.GetBool("poll", "enabled")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if !enabled {
+		return
+	}
+
+	interval, err := c.GetString("poll", "interval")
+	if (err != nil && err.(goconf.GetError).Reason == goconf.OptionNotFound) || interval == "" {
+		interval = "5m"
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	Config.Poll.Interval, err = time.ParseDuration(interval)
+	if err != nil || Config.Poll.Interval <= 0 {
+		log.Fatal("Invalid interval in [poll] section of deadci.ini. Please specify a duration such as 5m")
+	}
+
+	branches, err := c.GetString("poll", "branches")
+	if (err != nil && err.(goconf.GetError).Reason == goconf.OptionNotFound) || strings.TrimSpace(branches) == "" {
+		branches = "*"
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	Config.Poll.Branches = strings.Fields(branches)
+	for _, pattern := range Config.Poll.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatal("Invalid branch pattern " + pattern + " in [poll] section of deadci.ini")
+		}
+	}
+
+	repos, err := c.GetString("poll", "repos")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	for _, remote := range strings.Fields(repos) {
+		repo, err := ParsePollRepo(remote)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Config.Poll.Repos = append(Config.Poll.Repos, repo)
+	}
+	if len(Config.Poll.Repos) == 0 {
+		log.Fatal("No repos listed in [poll] section of deadci.ini")
+	}
+}
+
+// parseAgentsConfig reads the settings for agents connecting to this server from the [agents] section of deadci.ini
+func parseAgentsConfig(c *goconf.ConfigFile) {
+	var err error
+	Config.Agents.Enabled, err = c.GetBool("agents", "enabled")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if !Config.Agents.Enabled {
+		return
+	}
+	Config.Agents.Secret, err = c.GetString("agents", "secret")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	if strings.TrimSpace(Config.Agents.Secret) == "" {
+		log.Fatal("Missing secret in [agents] section of deadci.ini. Agents must authenticate to take builds.")
+	}
+	timeout, err := c.GetString("agents", "timeout")
+	if (err != nil && err.(goconf.GetError).Reason == goconf.OptionNotFound) || timeout == "" {
+		timeout = "1m"
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	Config.Agents.Timeout, err = time.ParseDuration(timeout)
+	if err != nil || Config.Agents.Timeout < 2*agentHeartbeatInterval {
+		log.Fatal("Invalid timeout in [agents] section of deadci.ini. Please specify a duration of at least " + (2 * agentHeartbeatInterval).String())
+	}
+}
+
+// parseAgentConfig reads the settings for `deadci agent` from the [agent] section of deadci.ini
+func parseAgentConfig(c *goconf.ConfigFile) {
+	var err error
+	for option, value := range map[string]*string{
+		"coordinator": &Config.Agent.Coordinator,
+		"secret":      &Config.Agent.Secret,
+		"name":        &Config.Agent.Name,
+	} {
+		*value, err = c.GetString("agent", option)
+		if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+			log.Fatal(err)
+		}
+		*value = strings.TrimSpace(*value)
+	}
+	Config.Agent.Coordinator = strings.TrimRight(Config.Agent.Coordinator, "/")
+	if Config.Agent.Name == "" {
+		Config.Agent.Name = Config.Host
+	}
+
+	labels, err := c.GetString("agent", "labels")
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	Config.Agent.Labels = strings.Fields(strings.ToLower(labels))
+
+	Config.Agent.Workers = getCount(c, "agent", "workers", runtime.NumCPU())
+}
+
+// parsePoolsConfig reads the extra worker pools from the [pools] section of deadci.ini. Each option is the name
+// of a pool, giving its number of workers followed by its labels.
+func parsePoolsConfig(c *goconf.ConfigFile) {
+	options, err := c.GetOptions("pools")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(options)
+	for _, name := range options {
+		// Options in the default section are seen in every section
+		if c.HasOption("", name) {
+			continue
+		}
+		value, err := c.GetString("pools", name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fields := strings.Fields(strings.ToLower(value))
+		workers := -1
+		if len(fields) != 0 {
+			workers, err = strconv.Atoi(fields[0])
+		}
+		if err != nil || workers < 0 {
+			log.Fatal("Invalid pool " + name + " in [pools] section of deadci.ini. Please give the number of workers followed by their labels, for example 2 docker heavy")
+		}
+		Config.Pools = append(Config.Pools, WorkerPool{Name: name, Workers: workers, Labels: fields[1:]})
+	}
+}
+
+// getCount reads an option that counts something, returning def if it is not set
+func getCount(c *goconf.ConfigFile, section, option string, def int) int {
+	value, err := c.GetString(section, option)
+	if err != nil && err.(goconf.GetError).Reason != goconf.OptionNotFound {
+		log.Fatal(err)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		where := "deadci.ini"
+		if section != "" {
+			where = "[" + section + "] section of deadci.ini"
+		}
+		log.Fatal("Invalid " + option + " in " + where + ". Please specify a number")
+	}
+	return n
+}
+
+// parseLabelsConfig reads the labels repositories need from the [labels] section of deadci.ini
+func parseLabelsConfig(c *goconf.ConfigFile) {
+	options, err := c.GetOptions("labels")
+	if err != nil {
+		log.Fatal(err)
+	}
+	Config.Labels = make(map[string][]string)
+	for _, label := range options {
+		// Options in the default section are seen in every section
+		if c.HasOption("", label) {
+			continue
+		}
+		patterns, err := c.GetString("labels", label)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, pattern := range strings.Fields(patterns) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatal("Invalid repository pattern " + pattern + " for label " + label + " in [labels] section of deadci.ini")
+			}
+			Config.Labels[label] = append(Config.Labels[label], pattern)
+		}
+	}
+}
+
+// parsePrioritiesConfig reads the priority rules from the [priorities] section of deadci.ini. Each option is a
+// priority, giving the patterns of the branches that have it.
+func parsePrioritiesConfig(c *goconf.ConfigFile) {
+	options, err := c.GetOptions("priorities")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, option := range options {
+		// Options in the default section are seen in every section
+		if c.HasOption("", option) {
+			continue
+		}
+		priority, err := strconv.Atoi(option)
+		if err != nil {
+			log.Fatal("Invalid priority " + option + " in [priorities] section of deadci.ini. Please specify a number")
+		}
+		patterns, err := c.GetString("priorities", option)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rule := PriorityRule{Priority: priority, Patterns: strings.Fields(patterns)}
+		for _, pattern := range rule.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatal("Invalid branch pattern " + pattern + " for priority " + option + " in [priorities] section of deadci.ini")
+			}
+		}
+		Config.Priorities = append(Config.Priorities, rule)
+	}
+	sort.Slice(Config.Priorities, func(i, j int) bool {
+		return Config.Priorities[i].Priority > Config.Priorities[j].Priority
+	})
+}
+
+// DefaultMaxLogSize is the maximum size of a build log when deadci.ini doesn't give one
+const DefaultMaxLogSize = 10 << 20
+
+// ParseByteSize parses a size in bytes, optionally with a K, M or G suffix, for example 512K
+func ParseByteSize(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("size must not be negative")
+	}
+	return n * multiplier, nil
+}
@@ -3,55 +3,252 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"log"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-const tableDef = `(
-	'id' INTEGER PRIMARY KEY AUTOINCREMENT,
-	'time' timestamp default CURRENT_TIMESTAMP,
-	'status' text NOT NULL,
-	'type' text NOT NULL, 
-	'domain' text NOT NULL,
-	'owner' text NOT NULL,
-	'repo' text NOT NULL,
-	'branch' text NOT NULL,
-	'commit' text NOT NULL,
-	'baseowner' text NOT NULL, 
-	'baserepo' text NOT NULL, 
-	'basebranch' text NOT NULL, 
-	'log' blob
-)`
+// A Store keeps events, their matrix jobs and their previous runs.
+// SQLite suits a single DeadCI server. PostgreSQL lets several servers share one queue.
+type Store interface {
+	// DB is the underlying database, used to apply migrations
+	DB() *sqlx.DB
+	// Migrations are the changes to the schema of this kind of database, in order
+	Migrations() []Migration
+	// HasTable checks if the database has a table
+	HasTable(name string) (bool, error)
+	// LockSchema stops other servers sharing the database from migrating it until the returned function is called
+	LockSchema() (func(), error)
+	// Recover puts back in the queue any builds this server left running when it last stopped
+	Recover() error
+	// Heartbeat marks the builds this server is running as still alive
+	Heartbeat() error
+	// Reap puts back in the queue the builds of other servers that haven't sent a heartbeat within the timeout,
+	// returning how many there were
+	Reap(timeout time.Duration) (int, error)
+
+	// PopEvent gets the pending event with the highest priority that accept returns true for, and that can be built
+	// without going over the limits on concurrent builds in deadci.ini, and marks it as running. Returns nil if there
+	// are none. Events of the same priority are taken oldest first.
+	PopEvent(accept func(*Event) bool) (*Event, error)
+	GetEventByID(id int) (*Event, error)
+	GetJob(domain, owner, repo, branch, commit string, job int) (*Event, error)
+	GetJobs(domain, owner, repo, branch, commit string) ([]Event, error)
+	GetActiveEvents(domain, owner, repo, branch string) ([]Event, error)
+	// GetBuilding gets the events being built, not counting matrix events waiting on their jobs
+	GetBuilding() ([]Event, error)
+	GetEvents(args ...string) ([]Event, error)
+	// DeleteJobs deletes matrix jobs, returning the ID and run of each one deleted
+	DeleteJobs(domain, owner, repo, branch, commit string, after int) ([]Event, error)
+	Insert(e *Event) error
+	Update(e *Event) error
+	// UpdateFrom saves the event if its row still has the run and node of the event, and has either the status from
+	// or the event's new status. Returns false if someone else has changed the row since the event was read.
+	UpdateFrom(e *Event, from string) (bool, error)
+	NumEvent(status string) (int, error)
+	// GetLastPullRequest gets the latest event queued for the same pull request as e, or nil if there is none
+	GetLastPullRequest(e *Event) (*Event, error)
+	// GetLastBuilt gets the latest event before e on the same branch that wasn't skipped, or nil if there is none.
+	// If e hasn't been inserted yet it gets the latest of them all.
+	GetLastBuilt(e *Event) (*Event, error)
+	// MaxPriority gets the highest priority of the pending events
+	MaxPriority() (int, error)
+	// SetPriority changes the priority of the event if it is still pending, returning false if it isn't
+	SetPriority(e *Event, priority int) (bool, error)
+	// Notify tells the other servers sharing the database that the queue has changed
+	Notify() error
+	// NotifyStop tells the other servers sharing the database to stop building the event, giving it its status
+	NotifyStop(e *Event) error
+	// Listen calls changed whenever another server sharing the database changes the queue, and stop whenever
+	// another server asks for the build of the event at path to be stopped with status
+	Listen(changed func(), stop func(path, status string)) error
+
+	InsertRun(run *Run) error
+	GetRuns(event int) ([]Run, error)
+	GetRun(event, number int) (*Run, error)
+	DeleteRuns(event int) error
+}
+
+// eventColumns are the columns of the deadci table that make up an Event
+const eventColumns = `id, time, status, "type", domain, owner, repo, branch, "commit", baseowner, baserepo, basebranch, job, matrix, run, labels, priority, node`
 
 var (
-	DB          *sqlx.DB
+	DB Store
+	// PopEventMux serializes taking events from an SQLite queue. PostgreSQL locks rows instead, as the servers
+	// sharing it don't share a mutex.
 	PopEventMux = &sync.Mutex{}
 )
 
 // Bootstrap database
 func InitDB() {
-	DB = sqlx.MustConnect("sqlite3", Config.DataDir+"/deadci.sqlite")
-	DB.MustExec("CREATE TABLE IF NOT EXISTS deadci " + tableDef)
-	DB.MustExec("CREATE INDEX IF NOT EXISTS status_index on deadci (status)")
-	DB.MustExec("CREATE INDEX IF NOT EXISTS domain_index on deadci (domain)")
-	DB.MustExec("CREATE INDEX IF NOT EXISTS owner_index on deadci (domain, owner)")
-	DB.MustExec("CREATE INDEX IF NOT EXISTS repo_index on deadci (domain, owner, repo)")
-	DB.MustExec("CREATE INDEX IF NOT EXISTS branch_index on deadci (domain, owner, repo, branch)")
-	DB.MustExec("CREATE UNIQUE INDEX IF NOT EXISTS combined_index on deadci (domain, owner, repo, branch, `commit`)")
+	OpenDB()
+	err := Migrate(func(migration Migration) {
+		log.Println("Applied database migration " + strconv.Itoa(migration.Version) + ": " + migration.Description)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Upon start-up, anything that is set to "running" should be moved to "pending"
-	DB.MustExec("UPDATE deadci SET status = 'pending' WHERE status = 'running'")
+	err = DB.Recover()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = DB.Listen(Queue.Notify, stopBuild)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// Get a pending event, mark it as running
-func PopEvent() (*Event, error) {
-	PopEventMux.Lock()
-	defer PopEventMux.Unlock()
+// OpenDB connects to the database configured in deadci.ini without bringing its schema up to date
+func OpenDB() {
+	var err error
+	switch Config.Database.Driver {
+	case "postgres":
+		DB, err = NewPostgresStore(Config.Database.URL)
+	default:
+		DB, err = NewSQLiteStore(Config.Database.URL)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(Config.DataDir+"/logs", 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Get a pending event that accept returns true for, mark it as running
+func PopEvent(accept func(*Event) bool) (*Event, error) {
+	e, err := DB.PopEvent(accept)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	if size, _ := e.LogSize(); size != 0 {
+		e.ResetLog([]byte("Retrying...\n"))
+	}
+	return e, nil
+}
 
+func GetEvent(domain, owner, repo, branch, commit string) (*Event, error) {
+	return GetJob(domain, owner, repo, branch, commit, 0)
+}
+
+// GetEventByID gets an event or matrix job by its ID
+func GetEventByID(id int) (*Event, error) {
+	return DB.GetEventByID(id)
+}
+
+// GetJob gets a single matrix job of an event. Job 0 is the event itself.
+func GetJob(domain, owner, repo, branch, commit string, job int) (*Event, error) {
+	return DB.GetJob(domain, owner, repo, branch, commit, job)
+}
+
+// GetJobs gets all the matrix jobs of an event, in order. The event itself is not included.
+func GetJobs(domain, owner, repo, branch, commit string) ([]Event, error) {
+	return DB.GetJobs(domain, owner, repo, branch, commit)
+}
+
+// GetActiveEvents gets the pending and running events for a branch, not including matrix jobs
+func GetActiveEvents(domain, owner, repo, branch string) ([]Event, error) {
+	return DB.GetActiveEvents(domain, owner, repo, branch)
+}
+
+// DeleteJobs deletes the matrix jobs of an event numbered higher than the given job
+func DeleteJobs(domain, owner, repo, branch, commit string, after int) error {
+	jobs, err := DB.DeleteJobs(domain, owner, repo, branch, commit, after)
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		err = jobs[i].DeleteRuns()
+		if err != nil {
+			return err
+		}
+		err = jobs[i].DeleteLog()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetEvents(args ...string) ([]Event, error) {
+	if len(args) > 5 {
+		panic("too many arguments to GetEvents()")
+	}
+	return DB.GetEvents(args...)
+}
+
+func (e *Event) Insert() error {
+	if e.ID != 0 {
+		return errors.New("Cannot Insert event with an ID. Use Update()")
+	}
+	if e.RunNumber == 0 {
+		e.RunNumber = 1
+	}
+	err := DB.Insert(e)
+	if err == nil && e.Status == StatusPending {
+		notifyQueue()
+	}
+	return err
+}
+
+func (e *Event) Update() error {
+	if e.ID == 0 {
+		return errors.New("Cannot update event with no ID. Use Insert()")
+	}
+	err := DB.Update(e)
+	// A finished build may leave room for another under the limits in deadci.ini
+	if err == nil && (e.Status == StatusPending || IsFinal(e.Status)) {
+		notifyQueue()
+	}
+	return err
+}
+
+// NumEvent gets the number of events that have the given status
+func NumEvent(status string) (int, error) {
+	return DB.NumEvent(status)
+}
+
+// sqlStore holds what the SQL databases have in common. Queries are written with ? placeholders and rebound
+// for the database, and identifiers that are also keywords are quoted with double quotes, which both understand.
+type sqlStore struct {
+	db *sqlx.DB
+}
+
+const insertEventQuery = `INSERT INTO deadci (time, status, "type", domain, owner, repo, branch, "commit", baseowner, baserepo, basebranch, job, matrix, run, labels, priority, node)
+	VALUES (:time, :status, :type, :domain, :owner, :repo, :branch, :commit, :baseowner, :baserepo, :basebranch, :job, :matrix, :run, :labels, :priority, :node)`
+
+// updateEventQuery saves an event. The heartbeat of a running build starts when it is saved as running.
+const updateEventQuery = `UPDATE deadci SET time = :time, status = :status, "type" = :type, domain = :domain, owner = :owner, repo = :repo, branch = :branch, "commit" = :commit, baseowner = :baseowner, baserepo = :baserepo, basebranch = :basebranch, job = :job, matrix = :matrix, run = :run, labels = :labels, priority = :priority, node = :node,
+	heartbeat = CASE WHEN :status = 'running' THEN CURRENT_TIMESTAMP ELSE heartbeat END WHERE id = :id`
+
+func (s *sqlStore) DB() *sqlx.DB {
+	return s.db
+}
+
+func (s *sqlStore) get(dest interface{}, query string, args ...interface{}) error {
+	return s.db.Get(dest, s.db.Rebind(query), args...)
+}
+
+func (s *sqlStore) selectAll(dest interface{}, query string, args ...interface{}) error {
+	return s.db.Select(dest, s.db.Rebind(query), args...)
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) error {
+	_, err := s.db.Exec(s.db.Rebind(query), args...)
+	return err
+}
+
+func (s *sqlStore) GetEventByID(id int) (*Event, error) {
 	event := Event{}
-	err := DB.Get(&event, "SELECT * FROM deadci WHERE status = 'pending' ORDER BY id ASC LIMIT 1")
+	err := s.get(&event, "SELECT "+eventColumns+" FROM deadci WHERE id = ?", id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -59,24 +256,12 @@ func PopEvent() (*Event, error) {
 			return nil, err
 		}
 	}
-	// Mark as running and return
-	event.Status = StatusRunning
-	if len(event.Log) != 0 {
-		event.Log = []byte("Retrying...\n")
-	}
-	e := &event
-	err = e.Update()
-	if err != nil {
-		return nil, err
-	}
-
-	return e, nil
+	return &event, nil
 }
 
-func GetEvent(domain, owner, repo, branch, commit string) (*Event, error) {
+func (s *sqlStore) GetJob(domain, owner, repo, branch, commit string, job int) (*Event, error) {
 	event := Event{}
-
-	err := DB.Get(&event, "SELECT * FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND `commit` = ?", domain, owner, repo, branch, commit)
+	err := s.get(&event, `SELECT `+eventColumns+` FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND "commit" = ? AND job = ?`, domain, owner, repo, branch, commit, job)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -87,14 +272,57 @@ func GetEvent(domain, owner, repo, branch, commit string) (*Event, error) {
 	return &event, nil
 }
 
-func GetEvents(args ...string) ([]Event, error) {
+func (s *sqlStore) GetJobs(domain, owner, repo, branch, commit string) ([]Event, error) {
 	events := []Event{}
+	err := s.selectAll(&events, `SELECT `+eventColumns+` FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND "commit" = ? AND job > 0 ORDER BY job ASC`, domain, owner, repo, branch, commit)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
 
-	if len(args) > 5 {
-		panic("too many arguments to GetEvents()")
+func (s *sqlStore) GetActiveEvents(domain, owner, repo, branch string) ([]Event, error) {
+	events := []Event{}
+	err := s.selectAll(&events, `SELECT `+eventColumns+` FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND job = 0 AND status IN (?, ?)`, domain, owner, repo, branch, StatusPending, StatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// waitingOnJobs matches the matrix events, aliased e, that have queued their jobs
+const waitingOnJobs = `e.job = 0 AND EXISTS (
+	SELECT 1 FROM deadci AS j WHERE j.job > 0 AND j.domain = e.domain AND j.owner = e.owner AND j.repo = e.repo AND j.branch = e.branch AND j."commit" = e."commit"
+)`
+
+// buildingQuery gets the events being built, see GetBuilding()
+const buildingQuery = `SELECT ` + eventColumns + ` FROM deadci AS e WHERE status = ? AND NOT (` + waitingOnJobs + `)`
+
+func (s *sqlStore) GetBuilding() ([]Event, error) {
+	events := []Event{}
+	err := s.selectAll(&events, buildingQuery, StatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// limitBuilds adds the limits on concurrent builds in deadci.ini to accept, counting the builds through q
+func limitBuilds(q sqlx.Ext, accept func(*Event) bool) (func(*Event) bool, error) {
+	if !hasBuildLimits() {
+		return accept, nil
+	}
+	building := []Event{}
+	err := sqlx.Select(q, &building, q.Rebind(buildingQuery), StatusRunning)
+	if err != nil {
+		return nil, err
 	}
+	return withinBuildLimits(building, accept), nil
+}
 
-	query := "SELECT time,status,domain,owner, repo, branch, `commit` FROM deadci"
+func (s *sqlStore) GetEvents(args ...string) ([]Event, error) {
+	events := []Event{}
+	query := `SELECT time, status, domain, owner, repo, branch, "commit", job, matrix, priority FROM deadci`
 	dbargs := make([]interface{}, 0)
 	if len(args) >= 1 {
 		query += " WHERE domain = ?"
@@ -109,7 +337,7 @@ func GetEvents(args ...string) ([]Event, error) {
 					query += " AND branch = ?"
 					dbargs = append(dbargs, args[3])
 					if len(args) == 5 {
-						query += " AND `commit` = ?"
+						query += ` AND "commit" = ?`
 						dbargs = append(dbargs, args[4])
 					}
 				}
@@ -117,50 +345,132 @@ func GetEvents(args ...string) ([]Event, error) {
 		}
 	}
 	query += " ORDER BY id DESC LIMIT 500"
-	err := DB.Select(&events, query, dbargs...)
+	err := s.selectAll(&events, query, dbargs...)
 	if err != nil {
 		return nil, err
 	}
 	return events, nil
 }
 
-func (e *Event) Insert() error {
-	if e.ID != 0 {
-		return errors.New("Cannot Insert event with an ID. Use Update()")
+func (s *sqlStore) DeleteJobs(domain, owner, repo, branch, commit string, after int) ([]Event, error) {
+	jobs := []Event{}
+	err := s.selectAll(&jobs, `SELECT id, run FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND "commit" = ? AND job > ?`, domain, owner, repo, branch, commit, after)
+	if err != nil {
+		return nil, err
+	}
+	err = s.exec(`DELETE FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND "commit" = ? AND job > ?`, domain, owner, repo, branch, commit, after)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *sqlStore) Update(e *Event) error {
+	_, err := s.db.NamedExec(updateEventQuery, e)
+	return err
+}
+
+// eventUpdate is an event to save along with the status its row is expected to have, see UpdateFrom()
+type eventUpdate struct {
+	Event
+	From string
+}
+
+func (s *sqlStore) UpdateFrom(e *Event, from string) (bool, error) {
+	res, err := s.db.NamedExec(updateEventQuery+` AND run = :run AND node = :node AND status IN (:status, :from)`, eventUpdate{*e, from})
+	if err != nil {
+		return false, err
 	}
+	rows, err := res.RowsAffected()
+	return rows != 0, err
+}
 
-	res, err := DB.NamedExec("INSERT INTO deadci (time,status,`type`,domain,owner, repo, branch, `commit`, baseowner, baserepo, basebranch, log) VALUES(:time, :status, :type, :domain, :owner, :repo, :branch, :commit, :baseowner, :baserepo, :basebranch, :log)", e)
+func (s *sqlStore) NumEvent(status string) (int, error) {
+	var num int
+	err := s.get(&num, "SELECT COUNT(*) FROM deadci WHERE status = ?", status)
 	if err != nil {
-		return err
-	} else {
-		id, err := res.LastInsertId()
-		if err != nil {
-			return err
+		return 0, err
+	}
+	return num, nil
+}
+
+func (s *sqlStore) GetLastPullRequest(e *Event) (*Event, error) {
+	event := Event{}
+	err := s.get(&event, `SELECT `+eventColumns+` FROM deadci WHERE "type" = 'pull_request' AND domain = ? AND owner = ? AND repo = ? AND branch = ? AND baseowner = ? AND baserepo = ? AND basebranch = ? AND job = 0 ORDER BY id DESC LIMIT 1`,
+		e.Domain, e.Owner, e.Repo, e.Branch, e.BaseOwner, e.BaseRepo, e.BaseBranch)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		} else {
-			e.ID = int(id)
-			return nil
+			return nil, err
 		}
 	}
+	return &event, nil
 }
 
-func (e *Event) Update() error {
-	if e.ID == 0 {
-		return errors.New("Cannot update event with no ID. Use Insert()")
-	}
-	_, err := DB.NamedExec("UPDATE deadci SET time = :time , status = :status, `type` = :type, domain = :domain, owner = :owner, repo = :repo, branch = :branch, `commit` = :commit, baseowner = :baseowner, baserepo = :baserepo, basebranch = :basebranch, log = :log WHERE id= :id", e)
+func (s *sqlStore) GetLastBuilt(e *Event) (*Event, error) {
+	event := Event{}
+	err := s.get(&event, "SELECT "+eventColumns+" FROM deadci WHERE domain = ? AND owner = ? AND repo = ? AND branch = ? AND job = 0 AND (id < ? OR ? = 0) AND status != ? ORDER BY id DESC LIMIT 1",
+		e.Domain, e.Owner, e.Repo, e.Branch, e.ID, e.ID, StatusSkipped)
 	if err != nil {
-		return err
-	} else {
-		return nil
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else {
+			return nil, err
+		}
 	}
+	return &event, nil
 }
 
-// NumEvent gets the number of events that have the given status
-func NumEvent(status string) (int, error) {
-	var num int
-	err := DB.QueryRowx("SELECT COUNT(*) FROM deadci WHERE status = ?", status).Scan(&num)
+func (s *sqlStore) MaxPriority() (int, error) {
+	var priority sql.NullInt64
+	err := s.get(&priority, "SELECT MAX(priority) FROM deadci WHERE status = ?", StatusPending)
 	if err != nil {
 		return 0, err
 	}
-	return num, nil
+	return int(priority.Int64), nil
+}
+
+func (s *sqlStore) SetPriority(e *Event, priority int) (bool, error) {
+	res, err := s.db.Exec(s.db.Rebind("UPDATE deadci SET priority = ? WHERE id = ? AND status = ?"), priority, e.ID, StatusPending)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows != 0 {
+		e.Priority = priority
+	}
+	return rows != 0, nil
+}
+
+func (s *sqlStore) InsertRun(run *Run) error {
+	return s.exec("INSERT INTO runs (event, run, status, time) VALUES (?, ?, ?, ?)", run.Event, run.Number, run.Status, run.Time)
+}
+
+func (s *sqlStore) GetRuns(event int) ([]Run, error) {
+	runs := []Run{}
+	err := s.selectAll(&runs, "SELECT id, event, run, status, time FROM runs WHERE event = ? ORDER BY run ASC", event)
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (s *sqlStore) GetRun(event, number int) (*Run, error) {
+	run := Run{}
+	err := s.get(&run, "SELECT id, event, run, status, time FROM runs WHERE event = ? AND run = ?", event, number)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *sqlStore) DeleteRuns(event int) error {
+	return s.exec("DELETE FROM runs WHERE event = ?", event)
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// postgresStore keeps events in a PostgreSQL database. Several DeadCI servers may share one, each taking builds
+// from the same queue.
+type postgresStore struct {
+	sqlStore
+	url string
+}
+
+// NewPostgresStore connects to the PostgreSQL database at url, for example postgres://deadci@localhost/deadci
+func NewPostgresStore(url string) (*postgresStore, error) {
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStore{sqlStore{db}, url}, nil
+}
+
+// postgresMigrations are the changes to the PostgreSQL schema, in order. Add new ones to the end, and never change
+// one that has been released.
+var postgresMigrations = []Migration{
+	{1, "Create the deadci and runs tables", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE deadci (
+				id SERIAL PRIMARY KEY,
+				time timestamptz NOT NULL DEFAULT now(),
+				status text NOT NULL,
+				"type" text NOT NULL,
+				domain text NOT NULL,
+				owner text NOT NULL,
+				repo text NOT NULL,
+				branch text NOT NULL,
+				"commit" text NOT NULL,
+				baseowner text NOT NULL,
+				baserepo text NOT NULL,
+				basebranch text NOT NULL,
+				job integer NOT NULL DEFAULT 0,
+				matrix text NOT NULL DEFAULT '',
+				run integer NOT NULL DEFAULT 1
+			)`,
+			"CREATE INDEX status_index on deadci (status)",
+			"CREATE INDEX domain_index on deadci (domain)",
+			"CREATE INDEX owner_index on deadci (domain, owner)",
+			"CREATE INDEX repo_index on deadci (domain, owner, repo)",
+			"CREATE INDEX branch_index on deadci (domain, owner, repo, branch)",
+			`CREATE UNIQUE INDEX combined_job_index on deadci (domain, owner, repo, branch, "commit", job)`,
+			`CREATE TABLE runs (
+				id SERIAL PRIMARY KEY,
+				event integer NOT NULL,
+				run integer NOT NULL,
+				status text NOT NULL,
+				time timestamptz NOT NULL
+			)`,
+			"CREATE UNIQUE INDEX runs_index on runs (event, run)",
+		)
+	}},
+	{2, "Add the labels builds need", func(tx *sqlx.Tx) error {
+		return execAll(tx, "ALTER TABLE deadci ADD COLUMN labels text NOT NULL DEFAULT ''")
+	}},
+	{3, "Add priorities to the queue", func(tx *sqlx.Tx) error {
+		return execAll(tx, "ALTER TABLE deadci ADD COLUMN priority integer NOT NULL DEFAULT 0")
+	}},
+	{4, "Record which server is running each build", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"ALTER TABLE deadci ADD COLUMN node text NOT NULL DEFAULT ''",
+			"ALTER TABLE deadci ADD COLUMN heartbeat timestamptz",
+		)
+	}},
+}
+
+func (s *postgresStore) Migrations() []Migration {
+	return postgresMigrations
+}
+
+func (s *postgresStore) HasTable(name string) (bool, error) {
+	var tables int
+	err := s.get(&tables, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?", name)
+	return tables != 0, err
+}
+
+// Keys of the advisory locks servers sharing the database take. They spell deadci, followed by a number for each.
+const (
+	// postgresMigrateLock is held while migrating, so that servers starting together apply each migration once
+	postgresMigrateLock = 0x64656164636901
+	// postgresPopLock is held while starting a build, when deadci.ini limits concurrent builds
+	postgresPopLock = 0x64656164636902
+)
+
+// LockSchema holds a session lock on a connection of its own, as migrations are applied in transactions on others
+func (s *postgresStore) LockSchema() (func(), error) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresMigrateLock)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", postgresMigrateLock)
+		if err != nil {
+			log.Println(err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// Recover leaves alone the builds of other servers sharing the database, which they may still be running.
+// Those of servers that have stopped for good are queued again by Reap().
+func (s *postgresStore) Recover() error {
+	return s.exec("UPDATE deadci SET status = ? WHERE status = ? AND node = ?", StatusPending, StatusRunning, Config.Database.Node)
+}
+
+func (s *postgresStore) Heartbeat() error {
+	return s.exec("UPDATE deadci SET heartbeat = now() WHERE status = ? AND node = ?", StatusRunning, Config.Database.Node)
+}
+
+// Reap goes by the database's clock, so that the servers' clocks needn't agree. Matrix events waiting on their
+// jobs are left alone, as they are finished by whoever builds the last job. The node is cleared, so that agents
+// still building for the server that has gone are told to stop by whichever server they reach.
+func (s *postgresStore) Reap(timeout time.Duration) (int, error) {
+	res, err := s.db.Exec(s.db.Rebind(`UPDATE deadci AS e SET status = ?, node = '' WHERE status = ? AND node != ?
+		AND (heartbeat IS NULL OR heartbeat < now() - make_interval(secs => ?)) AND NOT (`+waitingOnJobs+`)`),
+		StatusPending, StatusRunning, Config.Database.Node, timeout.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	return int(rows), err
+}
+
+// PopEvent skips rows locked by other servers popping at the same time, so that each event is built only once
+func (s *postgresStore) PopEvent(accept func(*Event) bool) (*Event, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Only one server at a time counts the builds running and starts another, so that together they keep to the
+	// limits in deadci.ini
+	if hasBuildLimits() {
+		_, err = tx.Exec(tx.Rebind("SELECT pg_advisory_xact_lock(?)"), postgresPopLock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	accept, err = limitBuilds(tx, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work through the queue in order, holding a lock on each event looked at until we are done
+	var last *Event
+	for {
+		event := Event{}
+		if last == nil {
+			err = tx.Get(&event, tx.Rebind("SELECT "+eventColumns+" FROM deadci WHERE status = 'pending' ORDER BY priority DESC, id ASC LIMIT 1 FOR UPDATE SKIP LOCKED"))
+		} else {
+			err = tx.Get(&event, tx.Rebind("SELECT "+eventColumns+" FROM deadci WHERE status = 'pending' AND (priority < ? OR (priority = ? AND id > ?)) ORDER BY priority DESC, id ASC LIMIT 1 FOR UPDATE SKIP LOCKED"), last.Priority, last.Priority, last.ID)
+		}
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !accept(&event) {
+			last = &event
+			continue
+		}
+		event.Status = StatusRunning
+		event.Node = Config.Database.Node
+		_, err = tx.Exec(tx.Rebind("UPDATE deadci SET status = ?, node = ?, heartbeat = now() WHERE id = ?"), event.Status, event.Node, event.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &event, nil
+	}
+}
+
+const (
+	// postgresQueueChannel is the channel servers sharing the database NOTIFY each other on when the queue changes
+	postgresQueueChannel = "deadci_queue"
+	// postgresStopChannel is the channel servers sharing the database ask each other to stop builds on. The payload
+	// is the status the build is given, a space, and the path of the event.
+	postgresStopChannel = "deadci_stop"
+)
+
+func (s *postgresStore) Notify() error {
+	return s.exec("NOTIFY " + postgresQueueChannel)
+}
+
+func (s *postgresStore) NotifyStop(e *Event) error {
+	return s.exec("SELECT pg_notify(?, ?)", postgresStopChannel, e.Status+" "+e.Path())
+}
+
+func (s *postgresStore) Listen(changed func(), stop func(path, status string)) error {
+	listener := pq.NewListener(s.url, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println(err)
+		}
+		// Notifications may have been missed while disconnected
+		if event == pq.ListenerEventReconnected {
+			changed()
+		}
+	})
+	for _, channel := range []string{postgresQueueChannel, postgresStopChannel} {
+		err := listener.Listen(channel)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	go func() {
+		for notification := range listener.Notify {
+			if notification != nil && notification.Channel == postgresStopChannel {
+				if parts := strings.SplitN(notification.Extra, " ", 2); len(parts) == 2 {
+					stop(parts[1], parts[0])
+				}
+				continue
+			}
+			changed()
+		}
+	}()
+	return nil
+}
+
+func (s *postgresStore) Insert(e *Event) error {
+	rows, err := s.db.NamedQuery(insertEventQuery+" RETURNING id", e)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return rows.Scan(&e.ID)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps events in an SQLite database file, by default deadci.sqlite in the data dir.
+// Only one server can use it at a time.
+type sqliteStore struct {
+	sqlStore
+}
+
+// NewSQLiteStore opens the SQLite database at path, creating it if need be
+func NewSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		path = Config.DataDir + "/deadci.sqlite"
+	}
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStore{sqlStore{db}}, nil
+}
+
+func (s *sqliteStore) Migrations() []Migration {
+	return sqliteMigrations
+}
+
+func (s *sqliteStore) HasTable(name string) (bool, error) {
+	var tables int
+	err := s.get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name)
+	return tables != 0, err
+}
+
+// LockSchema does nothing, as only one server can use an SQLite database
+func (s *sqliteStore) LockSchema() (func(), error) {
+	return func() {}, nil
+}
+
+func (s *sqliteStore) Recover() error {
+	return s.exec("UPDATE deadci SET status = ? WHERE status = ?", StatusPending, StatusRunning)
+}
+
+// Heartbeat does nothing, as only one server can use an SQLite database
+func (s *sqliteStore) Heartbeat() error {
+	return nil
+}
+
+// Reap does nothing, as only one server can use an SQLite database
+func (s *sqliteStore) Reap(timeout time.Duration) (int, error) {
+	return 0, nil
+}
+
+func (s *sqliteStore) PopEvent(accept func(*Event) bool) (*Event, error) {
+	PopEventMux.Lock()
+	defer PopEventMux.Unlock()
+
+	accept, err := limitBuilds(s.db, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the queue a row at a time, as most of the time the first event is taken
+	rows, err := s.db.Queryx("SELECT " + eventColumns + " FROM deadci WHERE status = 'pending' ORDER BY priority DESC, id ASC")
+	if err != nil {
+		return nil, err
+	}
+	var event *Event
+	for event == nil && rows.Next() {
+		pending := Event{}
+		err = rows.StructScan(&pending)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if accept(&pending) {
+			event = &pending
+		}
+	}
+	// The rows are closed before the event is updated, so that the read doesn't hold up the write
+	rows.Close()
+	if err = rows.Err(); err != nil || event == nil {
+		return nil, err
+	}
+
+	// Mark as running and return
+	event.Status = StatusRunning
+	event.Node = Config.Database.Node
+	err = s.Update(event)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Notify does nothing, as only one server can use an SQLite database
+func (s *sqliteStore) Notify() error {
+	return nil
+}
+
+// NotifyStop does nothing, as only one server can use an SQLite database
+func (s *sqliteStore) NotifyStop(e *Event) error {
+	return nil
+}
+
+func (s *sqliteStore) Listen(changed func(), stop func(path, status string)) error {
+	return nil
+}
+
+func (s *sqliteStore) Insert(e *Event) error {
+	res, err := s.db.NamedExec(insertEventQuery, e)
+	if err != nil {
+		return err
+	} else {
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		} else {
+			e.ID = int(id)
+			return nil
+		}
+	}
+}
+
+// sqliteMigrations are the changes to the SQLite schema, in order. Add new ones to the end, and never change one
+// that has been released. Databases from before migrations were recorded start at version 0, so every migration
+// must be safe to apply to a database that already has some or all of its changes.
+var sqliteMigrations = []Migration{
+	{1, "Create the deadci table", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS deadci "+v1TableDef,
+			"CREATE INDEX IF NOT EXISTS status_index on deadci (status)",
+			"CREATE INDEX IF NOT EXISTS domain_index on deadci (domain)",
+			"CREATE INDEX IF NOT EXISTS owner_index on deadci (domain, owner)",
+			"CREATE INDEX IF NOT EXISTS repo_index on deadci (domain, owner, repo)",
+			"CREATE INDEX IF NOT EXISTS branch_index on deadci (domain, owner, repo, branch)",
+			// The unique index on (domain, owner, repo, branch, commit) from before matrix jobs is left to the next
+			// migration, as a database that already has matrix jobs would not satisfy it
+		)
+	}},
+	{2, "Add matrix jobs", func(tx *sqlx.Tx) error {
+		err := addColumn(tx, "deadci", "job", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "deadci", "matrix", "text NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		// Matrix jobs share the commit of their event, so the unique index must include the job number
+		return execAll(tx,
+			"DROP INDEX IF EXISTS combined_index",
+			"CREATE UNIQUE INDEX IF NOT EXISTS combined_job_index on deadci (domain, owner, repo, branch, `commit`, job)",
+		)
+	}},
+	{3, "Add runs, so that every attempt at a build is kept", func(tx *sqlx.Tx) error {
+		err := addColumn(tx, "deadci", "run", "INTEGER NOT NULL DEFAULT 1")
+		if err != nil {
+			return err
+		}
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS runs "+sqliteRunsTableDef,
+			"CREATE UNIQUE INDEX IF NOT EXISTS runs_index on runs (event, run)",
+		)
+	}},
+	{4, "Move build logs out of the database into files", func(tx *sqlx.Tx) error {
+		err := nameLogsByRun()
+		if err != nil {
+			return err
+		}
+		return moveLogsToFiles(tx)
+	}},
+	{5, "Add the labels builds need", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "deadci", "labels", "text NOT NULL DEFAULT ''")
+	}},
+	{6, "Add priorities to the queue", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "deadci", "priority", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{7, "Record which server is running each build", func(tx *sqlx.Tx) error {
+		err := addColumn(tx, "deadci", "node", "text NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return addColumn(tx, "deadci", "heartbeat", "timestamp")
+	}},
+}
+
+// v1TableDef is the deadci table as it was first defined. Later migrations change it.
+const v1TableDef = `(
+	'id' INTEGER PRIMARY KEY AUTOINCREMENT,
+	'time' timestamp default CURRENT_TIMESTAMP,
+	'status' text NOT NULL,
+	'type' text NOT NULL,
+	'domain' text NOT NULL,
+	'owner' text NOT NULL,
+	'repo' text NOT NULL,
+	'branch' text NOT NULL,
+	'commit' text NOT NULL,
+	'baseowner' text NOT NULL,
+	'baserepo' text NOT NULL,
+	'basebranch' text NOT NULL,
+	'log' blob
+)`
+
+const sqliteRunsTableDef = `(
+	'id' INTEGER PRIMARY KEY AUTOINCREMENT,
+	'event' INTEGER NOT NULL,
+	'run' INTEGER NOT NULL,
+	'status' text NOT NULL,
+	'time' timestamp NOT NULL
+)`
+
+// addColumn adds a column to a table if it's not already there
+func addColumn(tx *sqlx.Tx, table, name, def string) error {
+	has, err := hasColumn(tx, table, name)
+	if err != nil || has {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN '" + name + "' " + def)
+	return err
+}
+
+// hasColumn checks if a table has a column
+func hasColumn(tx *sqlx.Tx, table, name string) (bool, error) {
+	columns := []struct {
+		Cid       int
+		Name      string
+		Type      string
+		NotNull   bool           `db:"notnull"`
+		DfltValue sql.NullString `db:"dflt_value"`
+		Pk        int
+	}{}
+	err := tx.Select(&columns, "PRAGMA table_info("+table+")")
+	if err != nil {
+		return false, err
+	}
+	for _, column := range columns {
+		if column.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// moveLogsToFiles writes any logs still stored in the database out to files, then clears them from the database
+func moveLogsToFiles(tx *sqlx.Tx) error {
+	has, err := hasColumn(tx, "deadci", "log")
+	if err != nil || !has {
+		return err
+	}
+	for {
+		row := struct {
+			ID  int
+			Run int
+			Log []byte
+		}{}
+		err := tx.Get(&row, "SELECT id, run, log FROM deadci WHERE log IS NOT NULL LIMIT 1")
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		event := Event{ID: row.ID, RunNumber: row.Run}
+		err = ioutil.WriteFile(event.LogFile(), row.Log, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE deadci SET log = NULL WHERE id = ?", row.ID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nameLogsByRun renames log files named after only their event, from before events could be run more than once
+func nameLogsByRun() error {
+	files, err := filepath.Glob(Config.DataDir + "/logs/*.log*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.Contains(name, "-") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		i := strings.Index(name, ".")
+		err = os.Rename(file, filepath.Join(filepath.Dir(file), name[:i]+"-1"+name[i:]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
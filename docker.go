@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ContainerRepoDir is where the checkout is mounted inside build containers
+	ContainerRepoDir = "/build"
+
+	// ContainerLabel marks containers started by DeadCI. Its value is the data directory of the DeadCI instance.
+	ContainerLabel = "com.deadci.instance"
+)
+
+// DockerExecutor runs each build command in a fresh container using docker, or any runtime with a compatible command line such as podman
+type DockerExecutor struct {
+	sync.Mutex
+	containers map[string]bool // Containers that are currently running
+	next       int             // Used to give each container a unique name
+}
+
+// NewDockerExecutor creates a DockerExecutor, removing any containers left behind by a previous run of DeadCI
+func NewDockerExecutor() *DockerExecutor {
+	d := &DockerExecutor{containers: map[string]bool{}}
+	out, err := exec.Command(Config.Docker.Runtime, "ps", "-aq", "--filter", "label="+ContainerLabel+"="+Config.DataDir).Output()
+	if err != nil {
+		log.Println("Unable to list leftover build containers: " + err.Error())
+		return d
+	}
+	for _, id := range strings.Fields(string(out)) {
+		d.remove(id)
+	}
+	return d
+}
+
+func (d *DockerExecutor) Command(e *Event, step BuildStep) (*exec.Cmd, func(), error) {
+	if step.Image == "" {
+		return nil, nil, errors.New("no container image configured. Please set an image in " + RepoConfigFile + " or in the [docker] section of deadci.ini")
+	}
+
+	d.Lock()
+	d.next++
+	name := "deadci-" + strconv.Itoa(e.ID) + "-" + strconv.Itoa(d.next)
+	d.containers[name] = true
+	d.Unlock()
+
+	args := []string{
+		"run", "--rm", "--name", name,
+		"--label", ContainerLabel + "=" + Config.DataDir,
+		"--volume", step.RepoDir + ":" + ContainerRepoDir,
+		"--workdir", path.Join(ContainerRepoDir, step.WorkDir),
+	}
+	// Run as the DeadCI user so that the checkout can be cleaned up afterwards
+	if uid := os.Getuid(); uid != -1 {
+		args = append(args, "--user", strconv.Itoa(uid)+":"+strconv.Itoa(os.Getgid()))
+	}
+	if Config.Docker.Memory != "" {
+		args = append(args, "--memory", Config.Docker.Memory)
+	}
+	if Config.Docker.CPUs != "" {
+		args = append(args, "--cpus", Config.Docker.CPUs)
+	}
+	// Pass variables by name so their values are taken from the environment of the runtime rather than its command line
+	for _, env := range step.Env {
+		args = append(args, "--env", strings.SplitN(env, "=", 2)[0])
+	}
+	args = append(args, step.Image)
+	args = append(args, step.Command...)
+
+	cmd := exec.Command(Config.Docker.Runtime, args...)
+	cmd.Env = append(os.Environ(), step.Env...)
+
+	// The container outlives the runtime process if it is killed, so always remove it
+	cleanup := func() {
+		d.Lock()
+		delete(d.containers, name)
+		d.Unlock()
+		d.remove(name)
+	}
+	return cmd, cleanup, nil
+}
+
+// Shutdown removes all running build containers
+func (d *DockerExecutor) Shutdown() {
+	d.Lock()
+	defer d.Unlock()
+	for name := range d.containers {
+		d.remove(name)
+		delete(d.containers, name)
+	}
+}
+
+// remove forcefully removes a container. Containers that have already gone are ignored.
+func (d *DockerExecutor) remove(name string) {
+	out, err := exec.Command(Config.Docker.Runtime, "rm", "--force", name).CombinedOutput()
+	if err != nil && !strings.Contains(strings.ToLower(string(out)), "no such container") {
+		log.Println("Unable to remove build container " + name + ": " + err.Error() + " " + string(out))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeRuntime points Config.Docker.Runtime at a script that records the arguments of each call, returning a
+// function that reads back the calls made so far
+func fakeRuntime(t *testing.T) func() [][]string {
+	dir, err := ioutil.TempDir("", "deadci-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtimeWas, dataDirWas := Config.Docker.Runtime, Config.DataDir
+	t.Cleanup(func() {
+		Config.Docker.Runtime, Config.DataDir = runtimeWas, dataDirWas
+		os.RemoveAll(dir)
+	})
+
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do printf '%s\\n' \"$arg\"; done >> '" + calls + "'\necho '<end>' >> '" + calls + "'\n"
+	Config.Docker.Runtime = filepath.Join(dir, "docker")
+	Config.DataDir = "/var/lib/deadci"
+	err = ioutil.WriteFile(Config.Docker.Runtime, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() [][]string {
+		out, err := ioutil.ReadFile(calls)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result [][]string
+		var call []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+			if line == "<end>" {
+				result = append(result, call)
+				call = nil
+				continue
+			}
+			call = append(call, line)
+		}
+		return result
+	}
+}
+
+func TestDockerExecutor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake runtime is a shell script")
+	}
+	calls := fakeRuntime(t)
+
+	d := NewDockerExecutor()
+	want := [][]string{{"ps", "-aq", "--filter", "label=" + ContainerLabel + "=/var/lib/deadci"}}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("listing leftover containers: got %q, want %q", got, want)
+	}
+
+	e := &Event{ID: 7}
+	step := BuildStep{
+		Command: []string{"make", "test"},
+		RepoDir: "/tmp/checkout",
+		WorkDir: "sub",
+		Env:     []string{"SECRET=hunter2", "DEADCI=true"},
+		Image:   "golang",
+	}
+	cmd, cleanup, err := d.Command(e, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := []string{
+		"run", "--rm", "--name", "deadci-7-1",
+		"--label", ContainerLabel + "=/var/lib/deadci",
+		"--volume", "/tmp/checkout:" + ContainerRepoDir,
+		"--workdir", ContainerRepoDir + "/sub",
+		"--user", strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid()),
+		"--env", "SECRET", "--env", "DEADCI",
+		"golang", "make", "test",
+	}
+	want = append(want, run)
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("running a step: got %q, want %q", got, want)
+	}
+	// Values are passed through the environment, never on the command line
+	found := false
+	for _, env := range cmd.Env {
+		found = found || env == "SECRET=hunter2"
+	}
+	if !found {
+		t.Errorf("SECRET=hunter2 is missing from the environment of the runtime")
+	}
+
+	cleanup()
+	want = append(want, []string{"rm", "--force", "deadci-7-1"})
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("cleaning up: got %q, want %q", got, want)
+	}
+
+	// Containers that are still running are removed on shutdown
+	_, _, err = d.Command(e, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Shutdown()
+	want = append(want, []string{"rm", "--force", "deadci-7-2"})
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("shutting down: got %q, want %q", got, want)
+	}
+	d.Shutdown()
+	if got := calls(); len(got) != len(want) {
+		t.Errorf("shutting down again removed containers again: %q", got[len(want):])
+	}
+
+	// Without an image nothing is run
+	step.Image = ""
+	_, _, err = d.Command(e, step)
+	if err == nil {
+		t.Errorf("expected an error for a step with no image")
+	}
+}
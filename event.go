@@ -1,17 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/go-github/github"
 	"github.com/phayes/hookserve/hookserve"
-	"golang.org/x/oauth2"
 )
 
 var (
@@ -20,37 +20,79 @@ var (
 	StatusSuccess    = "success"
 	StatusFailed     = "failed"
 	StatusFailedBoot = "failed-boot"
+	StatusCancelled  = "cancelled"
+	StatusTimedOut   = "timed-out"
+	StatusSuperseded = "superseded"
+	StatusSkipped    = "skipped"
 )
 
 type Event struct {
 	hookserve.Event
-	ID     int
-	Time   time.Time
-	Domain string
-	Status string
-	Log    []byte
+	ID        int
+	Time      time.Time
+	Domain    string
+	Status    string
+	Job       int    // Matrix job number. 0 for the event itself.
+	Matrix    string // Matrix values for the job, url-encoded
+	RunNumber int    `db:"run"` // Number of the current attempt at building the event, starting at 1. See NewRun().
+	Labels    string // Labels the repository's .deadci.yml asks for, space separated. See RequiredLabels().
+	Priority  int    // Events with a higher priority are built first. See RulePriority().
+	Node      string // Server that took the event from the queue, see Config.Database.Node
+
+	Log  []byte  `db:"-"` // Log, when loaded for display. Logs are stored in files, see LogFile().
+	Jobs []Event `db:"-"` // Matrix jobs, when loaded for display
+	Runs []Run   `db:"-"` // Previous attempts, when loaded for display
+
+	Message string `db:"-"` // Message of the commit, when the webhook that queued the event carried it
+
+	remote     *remoteBuild // Set when the event is being built by this agent for a coordinator, see runAgent()
+	skipReason string       // Why the event was skipped, when it was skipped here, see StatusDescription()
 }
 
 func (e *Event) Path() string {
-	return e.Domain + "/" + e.Owner + "/" + e.Repo + "/" + e.Branch + "/" + e.Commit
+	path := e.Domain + "/" + e.Owner + "/" + e.Repo + "/" + e.Branch + "/" + e.Commit
+	if e.Job != 0 {
+		path += "/jobs/" + strconv.Itoa(e.Job)
+	}
+	return path
 }
 
 func (e *Event) String() string {
 	out := "time:   " + e.Time.String() + "\n"
 	out += "domain: " + e.Domain + "\n"
 	out += e.Event.String()
+	if e.Job != 0 {
+		out += "job:    " + strconv.Itoa(e.Job) + "\n"
+		out += "matrix: " + e.MatrixString() + "\n"
+	}
+	if e.RunNumber > 1 {
+		out += "run:    " + strconv.Itoa(e.RunNumber) + "\n"
+	}
+	if e.Priority != 0 {
+		out += "priority: " + strconv.Itoa(e.Priority) + "\n"
+	}
 	out += "status: " + e.Status + "\n\n"
 	out += string(e.Log)
 	return out
 }
 
-// Run a test.
+// Run a test, on a worker or agent with the given labels.
 // This should be done inside a goroutine
-func (e *Event) Run() (string, error) {
+func (e *Event) Run(labels []string) (string, error) {
 	if e.Status != StatusRunning {
 		panic("Event should have it status set to `running` before calling Run()")
 	}
 	glog.Info("Run event " + e.FullURL())
+	ctx := RunningBuilds.Start(e)
+	defer RunningBuilds.Done(e)
+
+	// Another server sharing the database may have stopped the build before we were here to be told
+	if e.remote == nil {
+		if status, err := e.stoppedElsewhere(); status != "" {
+			return status, err
+		}
+	}
+
 	// Clean the scratch space
 	err := os.RemoveAll(Config.TempDir + "/deadci/" + e.Path())
 	if err != nil {
@@ -63,64 +105,133 @@ func (e *Event) Run() (string, error) {
 		return StatusFailedBoot, err
 	}
 
-	// Clone repo
-	glog.Info("Cloning repositories." + e.Owner + "/" + e.Repo)
-	cmdClone := exec.Command("git", "clone", "git@"+e.Domain+":"+e.Owner+"/"+e.Repo+".git")
-	if Config.HttpsClone == true {
-		cmdClone = exec.Command("git", "clone", "https://"+e.Domain+"/"+e.Owner+"/"+e.Repo+".git")
-	}
-	cmdClone.Dir = Config.TempDir + "/deadci/" + e.Path()
-	glog.Info("temp directory: " + cmdClone.Dir)
-	cmdCloneOut, err := cmdClone.CombinedOutput()
-	e.Log = append(e.Log, cmdCloneOut...)
+	// Clone repo and check out the commit
+	repoDir := Config.TempDir + "/deadci/" + e.Path() + "/" + e.Repo
+	err = e.checkout(repoDir)
 	if err != nil {
 		return StatusFailedBoot, err
 	}
 
-	// Check out correct commit 
-	cmdCheckoutBranch := exec.Command("git", "checkout", "-q", e.Branch)
-	cmdCheckoutBranch.Dir = Config.TempDir + "/deadci/" + e.Path() + "/" + e.Repo
-	cmdCheckoutBranchOut, err := cmdCheckoutBranch.CombinedOutput()
-	glog.Info(cmdCheckoutBranch.CombinedOutput())
-	e.Log = append(e.Log, cmdCheckoutBranchOut...)
+	// Load the repository's build configuration, if it has one
+	repoConfig, err := LoadRepoConfig(repoDir)
 	if err != nil {
-		return StatusFailedBoot, err
+		e.AppendLog([]byte("Unable to load " + RepoConfigFile + ": " + err.Error() + "\n"))
+		return StatusFailedBoot, errors.New("invalid " + RepoConfigFile)
 	}
-	cmdCheckout := exec.Command("git", "reset", "-q", "--hard", e.Commit)
-	cmdCheckout.Dir = Config.TempDir + "/deadci/" + e.Path() + "/" + e.Repo
-	cmdCheckoutOut, err := cmdCheckout.CombinedOutput()
-	glog.Info(cmdCheckout.CombinedOutput())
-	e.Log = append(e.Log, cmdCheckoutOut...)
+
+	// Builds the commit message or the filters leave out are skipped, unless they are being re-run
+	if e.Job == 0 && e.RunNumber == 1 {
+		if reason := e.checkFilters(repoDir, repoConfig); reason != "" {
+			return StatusSkipped, errors.New(reason)
+		}
+	}
+
+	// Builds that need labels we don't have go back in the queue. The labels are kept for matrix jobs and re-runs,
+	// so that they go straight to a worker that has them.
+	if required := repoConfig.GetLabels(); len(required) != 0 || e.Labels != "" {
+		e.Labels = strings.Join(required, " ")
+		if !hasLabels(labels, required) {
+			e.AppendLog([]byte(RepoConfigFile + " asks for labels: " + e.Labels + ". Queued again for a worker that has them.\n"))
+			return StatusPending, nil
+		}
+		if len(required) != 0 {
+			e.AppendLog([]byte(RepoConfigFile + " asks for labels: " + e.Labels + "\n"))
+		}
+	}
+
+	// A matrix build is split into jobs that are queued separately. The event stays running until they finish.
+	if e.Job == 0 {
+		matrix := repoConfig.MatrixJobs()
+		if len(matrix) != 0 {
+			err = e.expandMatrix(matrix)
+			if err != nil {
+				return StatusFailedBoot, err
+			}
+			return StatusRunning, nil
+		}
+	}
+
+	commands := repoConfig.Commands()
+	if len(commands) == 0 {
+		return StatusFailedBoot, errors.New("no " + RepoConfigFile + " found and no command configured in deadci.ini")
+	}
+
+	// Run the commands to do the testing, until they finish, time out or are cancelled
+	if timeout := repoConfig.GetTimeout(); timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	buildLog, err := newBuildLog(e)
 	if err != nil {
 		return StatusFailedBoot, err
 	}
+	defer buildLog.Close()
+	for _, command := range commands {
+		if ctx.Err() != nil {
+			return stoppedStatus(ctx)
+		}
+		if len(commands) > 1 {
+			buildLog.Print("$ " + command[2] + "\n")
+		}
+		env := append(e.Environ(), repoConfig.Environ()...)
+		env = append(env, e.MatrixEnviron()...)
+		cmd, cleanup, err := BuildExecutor.Command(e, BuildStep{
+			Command: command,
+			RepoDir: repoDir,
+			WorkDir: repoConfig.GetWorkDir(),
+			Env:     env,
+			Image:   repoConfig.GetImage(),
+		})
+		if err != nil {
+			return StatusFailedBoot, err
+		}
+		status, err := e.runCommand(ctx, cmd, buildLog)
+		cleanup()
+		if err != nil {
+			return status, err
+		}
+	}
+	return StatusSuccess, nil
+}
 
-	// Run the main command to do the testing
-	var cmd *exec.Cmd
-	if len(Config.Command) == 1 {
-		cmd = exec.Command(Config.Command[0])
-	} else {
-		cmd = exec.Command(Config.Command[0], Config.Command[1:]...)
-	}
-	cmd.Dir = Config.TempDir + "/deadci/" + e.Path() + "/" + e.Repo
-	cmd.Env = os.Environ()
-	cmd.Env = append(
-		cmd.Env,
-		"DEADCI_DOMAIN="+e.Domain,
-		"DEADCI_OWNER="+e.Owner,
-		"DEADCI_REPO="+e.Repo,
-		"DEADCI_BRANCH="+e.Branch,
-		"DEADCI_COMMIT="+e.Commit,
-		"DEADCI_TYPE="+e.Type,
-	)
+// checkout clones the repository of the event into dir. Agents clone from where the coordinator tells them to.
+func (e *Event) checkout(dir string) error {
+	if e.remote != nil {
+		return gitCheckout(e, e.remote.cloneURL, dir)
+	}
+	provider, err := GetProvider(e.Domain)
+	if err != nil {
+		return err
+	}
+	return provider.Checkout(e, dir)
+}
+
+// Environ returns the DEADCI_* environment variables describing the event
+func (e *Event) Environ() []string {
+	env := []string{
+		"DEADCI_DOMAIN=" + e.Domain,
+		"DEADCI_OWNER=" + e.Owner,
+		"DEADCI_REPO=" + e.Repo,
+		"DEADCI_BRANCH=" + e.Branch,
+		"DEADCI_COMMIT=" + e.Commit,
+		"DEADCI_TYPE=" + e.Type,
+	}
 	if e.Type == "pull_request" {
-		cmd.Env = append(
-			cmd.Env,
+		env = append(
+			env,
 			"DEADCI_BASEOWNER="+e.BaseOwner,
 			"DEADCI_BASEREPO="+e.BaseRepo,
 			"DEADCI_BASEBRANCH="+e.BaseBranch,
 		)
 	}
+	return env
+}
+
+// runCommand runs a single build command, collecting its output into the log.
+// The command and everything it started are killed if the context is done first.
+func (e *Event) runCommand(ctx context.Context, cmd *exec.Cmd, buildLog *buildLog) (string, error) {
+	setProcessGroup(cmd)
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
 		return StatusFailedBoot, err
@@ -133,44 +244,57 @@ func (e *Event) Run() (string, error) {
 	if err != nil {
 		return StatusFailed, err
 	}
-	// Collect stdout and stderr
-	stdoutbuff := make([]byte, 1024)
-	stderrbuff := make([]byte, 1024)
 
-	cmd.Run()
-	for {
-		done := false
-		//@@TODO: Move to buffio.Scanner and two seperate co-running go-routines
-		//@@TODO: This could very likely be highly refactored
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-stopped:
+		}
+	}()
 
-		// stdout
-		n, err := stdoutPipe.Read(stdoutbuff)
-		if err != nil {
-			if err == io.EOF {
-				done = true
-			} else {
-				return StatusFailed, err
-			}
+	// Collect stdout and stderr as they are written, until the command closes both
+	lines := make(chan logLine, 64)
+	readErrs := make(chan error, 2)
+	go func() { readErrs <- captureLines(stdoutPipe, "stdout", lines) }()
+	go func() { readErrs <- captureLines(stderrPipe, "stderr", lines) }()
+	go func() {
+		err := <-readErrs
+		if err2 := <-readErrs; err == nil {
+			err = err2
 		}
-		e.Log = append(e.Log, stdoutbuff[:n]...)
-		glog.Info(string(stdoutbuff[:n]))
-		// stderr
-		n, err = stderrPipe.Read(stderrbuff)
-		if err != nil {
-			if err == io.EOF {
-				done = true
-			} else {
-				return StatusFailed, err
+		readErrs <- err
+		close(lines)
+	}()
+
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	for lines != nil {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
 			}
+			err = buildLog.Write(line)
+		case <-ticker.C:
+			err = buildLog.Tick()
 		}
-		e.Log = append(e.Log, stderrbuff[:n]...)
-		e.Update()
-		if done {
-			break
+		if err != nil {
+			glog.Error(err)
 		}
 	}
+	readErr := <-readErrs
 
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return stoppedStatus(ctx)
+	}
+	if readErr != nil {
+		return StatusFailed, readErr
+	}
 	if err != nil {
 		return StatusFailed, err
 	} else {
@@ -178,21 +302,86 @@ func (e *Event) Run() (string, error) {
 	}
 }
 
+// stoppedStatus returns the status and error for a build that was stopped before it finished
+func stoppedStatus(ctx context.Context) (string, error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		return StatusTimedOut, errors.New("build timed out")
+	}
+	if context.Cause(ctx) == ErrSuperseded {
+		return StatusSuperseded, ErrSuperseded
+	}
+	return StatusCancelled, ErrCancelled
+}
+
 func (e *Event) Finalize(status string, err error) error {
+	// A matrix event that has queued its jobs is finalized once they are done
+	if status == StatusRunning && err == nil {
+		return nil
+	}
+
+	// An event that has been put back in the queue is finalized when it is built again
+	if status == StatusPending && err == nil {
+		from := e.Status
+		e.Status = status
+		ok, err := DB.UpdateFrom(e, from)
+		if err != nil || !ok {
+			return err
+		}
+		notifyQueue()
+		return e.Report()
+	}
+
+	ok, err := e.setFinal(status, err)
 	if err != nil {
-		e.Log = append(e.Log, []byte("\n"+status+": "+err.Error())...)
-	} else {
-		e.Log = append(e.Log, []byte("\n"+status)...)
+		return err
+	}
+	if !ok {
+		// Someone else has stopped the build or taken it on. Let anyone watching its log here know where it stands.
+		current, err := GetEventByID(e.ID)
+		if err == nil && current != nil && IsFinal(current.Status) {
+			LogStreams.Publish(e.Path(), logChunk{Status: current.Status})
+		}
+		return err
 	}
+	return e.reportFinal()
+}
 
+// setFinal records the final status of the event, and the error that brought it about if any, in its row and its
+// log. Returns false, recording nothing, if someone else has changed the event since it was read. A status that
+// someone else has already given it is recorded again, so that whoever is building the event finishes its log.
+func (e *Event) setFinal(status string, err error) (bool, error) {
+	from := e.Status
 	e.Status = status
-	err = e.Update()
+	ok, updateErr := DB.UpdateFrom(e, from)
+	if updateErr != nil || !ok {
+		return false, updateErr
+	}
+	notifyQueue()
+
+	if status == StatusSkipped && err != nil {
+		e.skipReason = err.Error()
+	}
 	if err != nil {
-		return err
+		e.AppendLog([]byte("\n" + status + ": " + err.Error()))
+	} else {
+		e.AppendLog([]byte("\n" + status))
+	}
+	return true, nil
+}
+
+// reportFinal lets the watchers of the log and the provider know the event has finished
+func (e *Event) reportFinal() error {
+	LogStreams.Publish(e.Path(), logChunk{Status: e.Status})
+
+	if Config.CompressLogs {
+		err := e.CompressLog()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Send the report to the provider
-	err = e.Report()
+	err := e.Report()
 	if err != nil {
 		return err
 	}
@@ -204,65 +393,18 @@ func (e *Event) FullURL() string {
 	return "http://" + Config.Host + ":" + strconv.Itoa(Config.Port) + "/" + e.Path()
 }
 
+// Report posts the status of the event back to its provider
 func (e *Event) Report() error {
-	if e.Domain == "github.com" {
-		err := e.ReportGitHub()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (e *Event) ReportGitHub() error {
-	// If github-token is not set, skip posting results
-	if Config.Github.Token == "" {
-		return nil
+	// Matrix jobs are reported as part of the combined status of their event
+	if e.Job != 0 {
+		return e.reportParent()
 	}
 
-	// Create the authorization transport
-	t := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: Config.Github.Token},
-	)
-	tc := oauth2.NewClient(oauth2.NoContext, t)
-	client := github.NewClient(tc)
-
-	status := e.TranslateStatus()
-	desc := e.StatusDescription()
-	url := e.FullURL()
-	repoStatus := &github.RepoStatus{
-		State:       &status,
-		TargetURL:   &url,
-		Description: &desc,
-	}
-
-	var err error
-	if e.Type == "push" {
-		_, _, err = client.Repositories.CreateStatus(e.Owner, e.Repo, e.Commit, repoStatus)
-	} else if e.Type == "pull_request" {
-		_, _, err = client.Repositories.CreateStatus(e.BaseOwner, e.BaseRepo, e.Commit, repoStatus)
-	}
+	provider, err := GetProvider(e.Domain)
 	if err != nil {
 		return err
 	}
-
-	// Leave a comment on the commit if it failed.  We don't leave a comment if there was an error or a pass.
-	if status == StatusFailed {
-		commentStr := "DeadCI - build " + e.Status + ": " + desc + "\n" + "For details please see: " + e.FullURL()
-		comment := &github.RepositoryComment{Body: &commentStr}
-
-		var err error
-		if e.Type == "push" {
-			_, _, err = client.Repositories.CreateComment(e.Owner, e.Repo, e.Commit, comment)
-		} else if e.Type == "pull_request" {
-			_, _, err = client.Repositories.CreateComment(e.BaseOwner, e.BaseRepo, e.Commit, comment)
-		}
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return provider.Report(e)
 }
 
 func (e *Event) StatusDescription() string {
@@ -272,33 +414,32 @@ func (e *Event) StatusDescription() string {
 		StatusSuccess:    "Build successful and tests passed",
 		StatusFailed:     "Build testing failed",
 		StatusFailedBoot: "Error bootstrapping build environment",
+		StatusCancelled:  "Build cancelled",
+		StatusTimedOut:   "Build timed out",
+		StatusSuperseded: "Build superseded by a newer commit",
+		StatusSkipped:    "Build skipped - nothing to build",
 	}
 	desc, ok := lookup[e.Status]
 	if !ok {
 		panic("Unknown status: " + e.Status)
 	}
+	if e.Status == StatusSkipped && e.skipReason != "" {
+		return "Build skipped - " + e.skipReason
+	}
 	return desc
 }
 
+// TranslateStatus returns the status of the event as its provider calls it
 func (e *Event) TranslateStatus() string {
-	lookup := map[string]map[string]string{
-		"github.com": map[string]string{
-			StatusPending:    "pending",
-			StatusRunning:    "pending",
-			StatusSuccess:    "success",
-			StatusFailed:     "failure",
-			StatusFailedBoot: "error",
-		},
-	}
-	translated, ok := lookup[e.Domain][e.Status]
-	if !ok {
-		panic("Unknown status: " + e.Domain + " " + e.Status)
+	provider, err := GetProvider(e.Domain)
+	if err != nil {
+		return e.Status
 	}
-	return translated
+	return provider.TranslateStatus(e.Status)
 }
 
 func (e *Event) MarshalJSON() ([]byte, error) {
-	jmap := map[string]string{
+	jmap := map[string]interface{}{
 		"time":   e.Time.String(),
 		"domain": e.Domain,
 		"owner":  e.Owner,
@@ -307,8 +448,24 @@ func (e *Event) MarshalJSON() ([]byte, error) {
 		"commit": e.Commit,
 		"status": e.Status,
 	}
+	if e.Job != 0 {
+		jmap["job"] = e.Job
+		jmap["matrix"] = e.MatrixValues()
+	}
 	if len(e.Log) != 0 {
 		jmap["log"] = string(e.Log)
 	}
+	if len(e.Jobs) != 0 {
+		jmap["jobs"] = e.Jobs
+	}
+	if e.RunNumber != 0 {
+		jmap["run"] = e.RunNumber
+	}
+	if len(e.Runs) != 0 {
+		jmap["runs"] = e.Runs
+	}
+	if e.Priority != 0 {
+		jmap["priority"] = e.Priority
+	}
 	return json.Marshal(jmap)
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// A BuildStep is a single command of a build
+type BuildStep struct {
+	Command []string
+	RepoDir string   // Root of the checkout
+	WorkDir string   // Directory relative to RepoDir to run the command in
+	Env     []string // Build environment: the DEADCI_* variables plus those from .deadci.yml and the matrix
+	Image   string   // Container image to run the command in, for executors that use one
+}
+
+// An Executor runs the commands of a build
+type Executor interface {
+	// Command prepares a build step to be run. The returned function cleans up after the step
+	// and must be called once the command has finished, however it finished.
+	Command(e *Event, step BuildStep) (*exec.Cmd, func(), error)
+
+	// Shutdown forcefully stops anything the executor still has running
+	Shutdown()
+}
+
+// SandboxInitCommand is the hidden subcommand that sets up the sandbox executor's namespaces
+const SandboxInitCommand = "sandbox-init"
+
+// BuildExecutor is the executor builds are run with
+var BuildExecutor Executor = HostExecutor{}
+
+// InitExecutor picks the executor configured in deadci.ini
+func InitExecutor() {
+	if Config.Docker.Enabled {
+		BuildExecutor = NewDockerExecutor()
+	}
+	if Config.Sandbox.Enabled {
+		sandbox, err := NewSandboxExecutor()
+		if err != nil {
+			log.Fatal(err)
+		}
+		BuildExecutor = sandbox
+	}
+}
+
+// HostExecutor runs build commands directly on the host as the DeadCI user
+type HostExecutor struct{}
+
+func (HostExecutor) Command(e *Event, step BuildStep) (*exec.Cmd, func(), error) {
+	cmd := exec.Command(step.Command[0], step.Command[1:]...)
+	cmd.Dir = filepath.Join(step.RepoDir, step.WorkDir)
+	cmd.Env = append(os.Environ(), step.Env...)
+	return cmd, func() {}, nil
+}
+
+func (HostExecutor) Shutdown() {}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Filters decide which pushes and pull requests are built. Branch filters in deadci.ini are applied when an event
+// is queued, and those in .deadci.yml once the repository is checked out. Path filters look at the files changed
+// since the last commit of the branch that was built, or for pull requests and new branches since the branch they
+// were made from, and skip the build if none of them are of interest. Directives in the message of the commit
+// can also skip its build, or build it whatever the filters say. Events left out are recorded as skipped.
+// Re-running a skipped build builds it anyway.
+
+// skipDirectives in a commit message ask for it not to be built
+var skipDirectives = []string{"[skip ci]", "[ci skip]", "[deadci skip]"}
+
+// buildDirective in a commit message asks for it to be built even if the filters leave it out
+const buildDirective = "[deadci rebuild-all]"
+
+// skipDirective returns the directive in the commit message asking for it not to be built, or "" if there is none
+func skipDirective(message string) string {
+	message = strings.ToLower(message)
+	for _, directive := range skipDirectives {
+		if strings.Contains(message, directive) {
+			return directive
+		}
+	}
+	return ""
+}
+
+// hasBuildDirective checks whether the commit message asks for it to be built whatever the filters say
+func hasBuildDirective(message string) bool {
+	return strings.Contains(strings.ToLower(message), buildDirective)
+}
+
+// A Filter picks out the branches, or the changed files, that trigger builds
+type Filter struct {
+	Only   []string `yaml:"only"`   // If given, only names matching one of these patterns trigger builds
+	Except []string `yaml:"except"` // Names matching one of these patterns never trigger builds
+}
+
+// Empty returns true if the filter lets everything through
+func (f Filter) Empty() bool {
+	return len(f.Only) == 0 && len(f.Except) == 0
+}
+
+// Validate checks that the filter's patterns are well formed
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Only...), f.Except...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+// allows checks that the name passes the filter, given a function matching a pattern against a name
+func (f Filter) allows(name string, match func(pattern, name string) bool) bool {
+	for _, pattern := range f.Except {
+		if match(pattern, name) {
+			return false
+		}
+	}
+	if len(f.Only) == 0 {
+		return true
+	}
+	for _, pattern := range f.Only {
+		if match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsBranch checks that builds of the branch pass the filter. Branch patterns are as understood by path.Match.
+func (f Filter) AllowsBranch(branch string) bool {
+	return f.allows(branch, func(pattern, name string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// AllowsFile checks that a change to the file passes the filter
+func (f Filter) AllowsFile(file string) bool {
+	return f.allows(file, matchFile)
+}
+
+// matchFile checks a file, given by its path from the root of the repository, against a pattern. A pattern without
+// a slash, such as *.md or docs, matches the name of the file or of any directory it is in. A pattern with a slash,
+// such as docs/*.md or /docs, matches the whole path of the file, or of a directory it is in.
+func matchFile(pattern, file string) bool {
+	if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+		pattern = strings.TrimSuffix(pattern, "/")
+		for _, name := range strings.Split(file, "/") {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	pattern = strings.Trim(pattern, "/")
+	for p := file; p != "." && p != "/"; p = path.Dir(p) {
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBranch returns the branch that branch filters are checked against: the branch pushed to, or the branch a
+// pull request is to be merged into
+func (e *Event) filterBranch() string {
+	if e.Type == "pull_request" && e.BaseBranch != "" {
+		return e.BaseBranch
+	}
+	return e.Branch
+}
+
+// SkipReason returns why the event shouldn't be queued, going by its commit message and the branch filters in
+// deadci.ini, or "" if it should
+func (e *Event) SkipReason() string {
+	if directive := skipDirective(e.Message); directive != "" {
+		return "the commit message says " + directive
+	}
+	if !hasBuildDirective(e.Message) && !Config.Branches.AllowsBranch(e.filterBranch()) {
+		return "branch " + e.filterBranch() + " is not built, see branches and skipbranches in deadci.ini"
+	}
+	return ""
+}
+
+// Skip records a new event as skipped for the reason, without building it
+func (e *Event) Skip(reason string) error {
+	e.Status = StatusSkipped
+	err := e.Insert()
+	if err != nil {
+		return err
+	}
+	return e.Finalize(StatusSkipped, errors.New(reason))
+}
+
+// checkFilters returns why the commit message or the filters leave the event out now that its repository is checked
+// out in repoDir, or "" if they don't. If the files changed can't be worked out the event is built.
+func (e *Event) checkFilters(repoDir string, repoConfig *RepoConfig) string {
+	// Not every event carries its commit message, so look at the commit itself
+	out, err := exec.Command("git", "-C", repoDir, "log", "-1", "--format=%B", "HEAD").Output()
+	if err != nil {
+		e.AppendLog([]byte("Unable to read the commit message: " + err.Error() + "\n"))
+	}
+	message := string(out)
+	if directive := skipDirective(message); directive != "" {
+		return "the commit message says " + directive
+	}
+	if hasBuildDirective(message) {
+		e.AppendLog([]byte("The commit message says " + buildDirective + ", so building whatever the filters say\n"))
+		return ""
+	}
+
+	if repoConfig != nil && !repoConfig.Branches.AllowsBranch(e.filterBranch()) {
+		return "branch " + e.filterBranch() + " is not built, see branches in " + RepoConfigFile
+	}
+
+	// The coordinator of an agent works out what to compare with, as it knows what has been built
+	paths, since := Config.Paths, ""
+	if e.remote != nil {
+		paths, since = e.remote.paths, e.remote.since
+	} else {
+		var err error
+		since, err = e.diffBase()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	var repoPaths Filter
+	if repoConfig != nil {
+		repoPaths = repoConfig.Paths
+	}
+	if (paths.Empty() && repoPaths.Empty()) || since == "" {
+		return ""
+	}
+
+	out, err = exec.Command("git", "-C", repoDir, "diff", "--name-only", "-z", since+"...HEAD").Output()
+	if err != nil {
+		e.AppendLog([]byte("Unable to list the files changed since " + since + ", so building anyway: " + err.Error() + "\n"))
+		return ""
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	for _, file := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		if paths.AllowsFile(file) && repoPaths.AllowsFile(file) {
+			return ""
+		}
+	}
+	return "only files left out by the path filters changed since " + since
+}
+
+// diffBase returns the revision path filters compare the event's commit with, or "" if there is none
+func (e *Event) diffBase() (string, error) {
+	if e.Type == "pull_request" {
+		// The base branch can only be compared with if the pull request is within the one repository
+		if e.BaseBranch == "" || (e.BaseOwner != "" && e.BaseOwner != e.Owner) || (e.BaseRepo != "" && e.BaseRepo != e.Repo) {
+			return "", nil
+		}
+		return "origin/" + e.BaseBranch, nil
+	}
+	last, err := DB.GetLastBuilt(e)
+	if err != nil {
+		return "", err
+	}
+	if last != nil {
+		return last.Commit, nil
+	}
+	return "origin/HEAD", nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// GiteaServer receives Gitea and Forgejo push and pull request webhooks.
+// It is the Gitea counterpart of hookserve.Server and passes events to GiteaServer.Events in the same form.
+type GiteaServer struct {
+	Secret string            // Optional secret key for authenticating via HMAC
+	Events chan WebhookEvent // Channel of events. Read from this channel to get events as they happen.
+}
+
+// NewGiteaServer creates a new Gitea webhook receiver
+func NewGiteaServer() *GiteaServer {
+	return &GiteaServer{
+		Events: make(chan WebhookEvent, 10), // buffered to 10 items
+	}
+}
+
+type giteaRepository struct {
+	Name  string `json:"name"`
+	Owner struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+type giteaPushHook struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	HeadCommit *struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+	Repository giteaRepository `json:"repository"`
+}
+
+type giteaPullRequestHook struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		Head struct {
+			Ref  string          `json:"ref"`
+			Sha  string          `json:"sha"`
+			Repo giteaRepository `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref  string          `json:"ref"`
+			Repo giteaRepository `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// Satisfies the http.Handler interface
+func (s *GiteaServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if req.Method != "POST" {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Forgejo sends its own headers as well as the Gitea ones, but accept either
+	eventType := req.Header.Get("X-Gitea-Event")
+	if eventType == "" {
+		eventType = req.Header.Get("X-Forgejo-Event")
+	}
+	if eventType == "" {
+		http.Error(w, "400 Bad Request - Missing X-Gitea-Event Header", http.StatusBadRequest)
+		return
+	}
+	if eventType != "push" && eventType != "pull_request" {
+		http.Error(w, "400 Bad Request - Unknown Event Type "+eventType, http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If we have a Secret set, we should check the MAC
+	if s.Secret != "" {
+		sig := req.Header.Get("X-Gitea-Signature")
+		if sig == "" {
+			sig = req.Header.Get("X-Forgejo-Signature")
+		}
+		if sig == "" {
+			http.Error(w, "403 Forbidden - Missing X-Gitea-Signature required for HMAC verification", http.StatusForbidden)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write(body)
+		expectedSig := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expectedSig), []byte(strings.ToLower(sig))) {
+			http.Error(w, "403 Forbidden - HMAC verification failed", http.StatusForbidden)
+			return
+		}
+	}
+
+	event := WebhookEvent{}
+	if eventType == "push" {
+		hook := giteaPushHook{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// If the ref is not a branch, or the branch was deleted, we don't care about it
+		if !strings.HasPrefix(hook.Ref, "refs/heads/") || strings.Trim(hook.After, "0") == "" {
+			return
+		}
+
+		event.Type = "push"
+		event.Branch = hook.Ref[11:]
+		event.Commit = hook.After
+		event.Owner = hook.Repository.Owner.Login
+		event.Repo = hook.Repository.Name
+		if hook.HeadCommit != nil {
+			event.Message = hook.HeadCommit.Message
+		}
+	} else {
+		hook := giteaPullRequestHook{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr := hook.PullRequest
+
+		event.Type = "pull_request"
+		event.Action = hook.Action
+		if event.Action == "synchronized" {
+			// Gitea's name for GitHub's "synchronize"
+			event.Action = "synchronize"
+		}
+		event.Owner = pr.Head.Repo.Owner.Login
+		event.Repo = pr.Head.Repo.Name
+		event.Branch = pr.Head.Ref
+		event.Commit = pr.Head.Sha
+		event.BaseOwner = pr.Base.Repo.Owner.Login
+		event.BaseRepo = pr.Base.Repo.Name
+		event.BaseBranch = pr.Base.Ref
+	}
+
+	if event.Owner == "" || event.Repo == "" || event.Commit == "" {
+		http.Error(w, "400 Bad Request - Incomplete "+eventType+" payload", http.StatusBadRequest)
+		return
+	}
+
+	// We've built our Event - put it into the channel and we're done
+	go func() {
+		s.Events <- event
+	}()
+
+	w.Write([]byte(event.String()))
+}
+
+// giteaProvider builds repositories hosted on a self-hosted Gitea server
+type giteaProvider struct {
+	config   *ServerConfig
+	receiver *GiteaServer
+}
+
+// NewGiteaProvider creates the Gitea provider from the [gitea] section of the config
+func NewGiteaProvider() Provider {
+	receiver := NewGiteaServer()
+	receiver.Secret = Config.Gitea.Secret
+	return &giteaProvider{config: &Config.Gitea, receiver: receiver}
+}
+
+var giteaStatuses = statusMap{
+	StatusPending:    "pending",
+	StatusRunning:    "pending",
+	StatusSuccess:    "success",
+	StatusFailed:     "failure",
+	StatusFailedBoot: "error",
+	StatusCancelled:  "error",
+	StatusTimedOut:   "failure",
+	StatusSuperseded: "warning",
+	StatusSkipped:    "pending", // Gitea has no neutral state, and a skipped build must not pass required checks
+}
+
+func (p *giteaProvider) Name() string   { return "Gitea" }
+func (p *giteaProvider) Domain() string { return p.config.Domain }
+
+func (p *giteaProvider) Webhook() (string, http.Handler) { return "/gitea", p.receiver }
+func (p *giteaProvider) Events() <-chan WebhookEvent     { return p.receiver.Events }
+
+func (p *giteaProvider) CloneURL(e *Event) string {
+	if Config.HttpsClone {
+		return p.config.URL + "/" + e.Owner + "/" + e.Repo + ".git"
+	}
+	return sshCloneURL(e)
+}
+
+func (p *giteaProvider) Checkout(e *Event, dir string) error {
+	return gitCheckout(e, p.CloneURL(e), dir)
+}
+
+func (p *giteaProvider) TranslateStatus(status string) string {
+	return giteaStatuses.Translate(status)
+}
+
+// Report posts the status of the event to the Gitea commit status API
+func (p *giteaProvider) Report(e *Event) error {
+	// If gitea token is not set, skip posting results
+	if p.config.Token == "" {
+		return nil
+	}
+
+	owner, repo := e.Owner, e.Repo
+	if e.Type == "pull_request" {
+		owner, repo = e.BaseOwner, e.BaseRepo
+	}
+
+	status, err := json.Marshal(map[string]string{
+		"state":       e.TranslateStatus(),
+		"target_url":  e.FullURL(),
+		"description": e.StatusDescription(),
+		"context":     "deadci",
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.config.URL+"/api/v1/repos/"+owner+"/"+repo+"/statuses/"+e.Commit, bytes.NewReader(status))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "token "+p.config.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Gitea status update failed: " + resp.Status + " " + string(body))
+	}
+	return nil
+}
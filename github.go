@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/go-github/github"
+	"github.com/phayes/hookserve/hookserve"
+	"golang.org/x/oauth2"
+)
+
+// githubProvider builds repositories hosted on github.com
+type githubProvider struct {
+	receiver *GithubServer
+}
+
+// NewGithubProvider creates the github.com provider from the [github] section of the config
+func NewGithubProvider() Provider {
+	receiver := NewGithubServer()
+	receiver.Secret = Config.Github.Secret
+	return &githubProvider{receiver: receiver}
+}
+
+// GithubServer receives GitHub push and pull request webhooks. They are checked and parsed by hookserve.Server,
+// and passed to GithubServer.Events along with the message of the commit, which hookserve leaves out.
+type GithubServer struct {
+	Path   string            // Path to receive on
+	Secret string            // Optional secret key for authenticating via HMAC
+	Events chan WebhookEvent // Channel of events. Read from this channel to get events as they happen.
+}
+
+// NewGithubServer creates a new GitHub webhook receiver
+func NewGithubServer() *GithubServer {
+	return &GithubServer{
+		Path:   hookserve.NewServer().Path,
+		Events: make(chan WebhookEvent, 10), // buffered to 10 items
+	}
+}
+
+// githubPush is the part of a GitHub push webhook that hookserve leaves out
+type githubPush struct {
+	HeadCommit struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+}
+
+// hookResponse notes whether a webhook receiver accepted the webhook it was handed
+type hookResponse struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *hookResponse) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *hookResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Satisfies the http.Handler interface
+func (s *GithubServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Each webhook gets a hookserve.Server of its own, so that the event it passes on is the one for this webhook
+	hooks := hookserve.NewServer()
+	hooks.Path = s.Path
+	hooks.Secret = s.Secret
+	response := &hookResponse{ResponseWriter: w}
+	hooks.ServeHTTP(response, req)
+
+	// hookserve only passes on an event when it answers with it, which it doesn't for webhooks it rejects or ignores
+	if response.status != http.StatusOK {
+		return
+	}
+	event := WebhookEvent{Event: <-hooks.Events}
+	if event.Type == "push" {
+		push := githubPush{}
+		if json.Unmarshal(body, &push) == nil {
+			event.Message = push.HeadCommit.Message
+		}
+	}
+
+	go func() {
+		s.Events <- event
+	}()
+}
+
+var githubStatuses = statusMap{
+	StatusPending:    "pending",
+	StatusRunning:    "pending",
+	StatusSuccess:    "success",
+	StatusFailed:     "failure",
+	StatusFailedBoot: "error",
+	StatusCancelled:  "error",
+	StatusTimedOut:   "failure",
+	StatusSuperseded: "error",
+	StatusSkipped:    "pending", // GitHub has no neutral state, and a skipped build must not pass required checks
+}
+
+func (p *githubProvider) Name() string   { return "GitHub" }
+func (p *githubProvider) Domain() string { return "github.com" }
+
+func (p *githubProvider) Webhook() (string, http.Handler) { return p.receiver.Path, p.receiver }
+func (p *githubProvider) Events() <-chan WebhookEvent     { return p.receiver.Events }
+
+func (p *githubProvider) CloneURL(e *Event) string {
+	if Config.HttpsClone {
+		return "https://" + e.Domain + "/" + e.Owner + "/" + e.Repo + ".git"
+	}
+	return sshCloneURL(e)
+}
+
+func (p *githubProvider) Checkout(e *Event, dir string) error {
+	return gitCheckout(e, p.CloneURL(e), dir)
+}
+
+func (p *githubProvider) TranslateStatus(status string) string {
+	return githubStatuses.Translate(status)
+}
+
+// Report posts the status of the event to the GitHub commit status API, commenting on failed commits
+func (p *githubProvider) Report(e *Event) error {
+	// If github-token is not set, skip posting results
+	if Config.Github.Token == "" {
+		return nil
+	}
+
+	// Create the authorization transport
+	t := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: Config.Github.Token},
+	)
+	tc := oauth2.NewClient(oauth2.NoContext, t)
+	client := github.NewClient(tc)
+
+	status := e.TranslateStatus()
+	desc := e.StatusDescription()
+	url := e.FullURL()
+	repoStatus := &github.RepoStatus{
+		State:       &status,
+		TargetURL:   &url,
+		Description: &desc,
+	}
+
+	var err error
+	if e.Type == "push" {
+		_, _, err = client.Repositories.CreateStatus(e.Owner, e.Repo, e.Commit, repoStatus)
+	} else if e.Type == "pull_request" {
+		_, _, err = client.Repositories.CreateStatus(e.BaseOwner, e.BaseRepo, e.Commit, repoStatus)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Leave a comment on the commit if it failed.  We don't leave a comment if there was an error or a pass.
+	if status == StatusFailed {
+		commentStr := "DeadCI - build " + e.Status + ": " + desc + "\n" + "For details please see: " + e.FullURL()
+		comment := &github.RepositoryComment{Body: &commentStr}
+
+		var err error
+		if e.Type == "push" {
+			_, _, err = client.Repositories.CreateComment(e.Owner, e.Repo, e.Commit, comment)
+		} else if e.Type == "pull_request" {
+			_, _, err = client.Repositories.CreateComment(e.BaseOwner, e.BaseRepo, e.Commit, comment)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
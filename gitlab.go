@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GitlabServer receives GitLab push and merge request webhooks.
+// It is the GitLab counterpart of hookserve.Server and passes events to GitlabServer.Events in the same form.
+type GitlabServer struct {
+	Secret string            // Optional secret token, checked against the X-Gitlab-Token header
+	Events chan WebhookEvent // Channel of events. Read from this channel to get events as they happen.
+}
+
+// NewGitlabServer creates a new GitLab webhook receiver
+func NewGitlabServer() *GitlabServer {
+	return &GitlabServer{
+		Events: make(chan WebhookEvent, 10), // buffered to 10 items
+	}
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+type gitlabPushHook struct {
+	Ref         string         `json:"ref"`
+	After       string         `json:"after"`
+	CheckoutSha string         `json:"checkout_sha"`
+	Project     gitlabProject  `json:"project"`
+	Commits     []gitlabCommit `json:"commits"`
+}
+
+type gitlabCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+type gitlabMergeRequestHook struct {
+	ObjectAttributes struct {
+		Action       string        `json:"action"`
+		OldRev       string        `json:"oldrev"`
+		SourceBranch string        `json:"source_branch"`
+		TargetBranch string        `json:"target_branch"`
+		Source       gitlabProject `json:"source"`
+		Target       gitlabProject `json:"target"`
+		LastCommit   gitlabCommit  `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// splitProjectPath splits a GitLab "namespace/project" path into owner and repo.
+// Projects in nested groups are rejected, as builds are addressed by a single owner segment.
+func splitProjectPath(path string) (string, string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		return "", "", errors.New("Projects in nested groups are not supported: " + path)
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("Invalid project path " + path)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Satisfies the http.Handler interface
+func (s *GitlabServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if req.Method != "POST" {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventType := req.Header.Get("X-Gitlab-Event")
+	if eventType == "" {
+		http.Error(w, "400 Bad Request - Missing X-Gitlab-Event Header", http.StatusBadRequest)
+		return
+	}
+	if eventType != "Push Hook" && eventType != "Merge Request Hook" {
+		http.Error(w, "400 Bad Request - Unknown Event Type "+eventType, http.StatusBadRequest)
+		return
+	}
+
+	// If we have a Secret set, check the token
+	if s.Secret != "" {
+		token := req.Header.Get("X-Gitlab-Token")
+		if token == "" {
+			http.Error(w, "403 Forbidden - Missing X-Gitlab-Token required for verification", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Secret)) != 1 {
+			http.Error(w, "403 Forbidden - Token verification failed", http.StatusForbidden)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := WebhookEvent{}
+	if eventType == "Push Hook" {
+		hook := gitlabPushHook{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// If the ref is not a branch, or the branch was deleted, we don't care about it
+		if !strings.HasPrefix(hook.Ref, "refs/heads/") || hook.CheckoutSha == "" {
+			return
+		}
+
+		event.Type = "push"
+		event.Branch = hook.Ref[11:]
+		event.Commit = hook.CheckoutSha
+		for _, commit := range hook.Commits {
+			if commit.ID == hook.CheckoutSha {
+				event.Message = commit.Message
+			}
+		}
+		event.Owner, event.Repo, err = splitProjectPath(hook.Project.PathWithNamespace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		hook := gitlabMergeRequestHook{}
+		err = json.Unmarshal(body, &hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs := hook.ObjectAttributes
+
+		// Translate the action into its GitHub equivalent
+		switch attrs.Action {
+		case "open":
+			event.Action = "opened"
+		case "reopen":
+			event.Action = "reopened"
+		case "update":
+			// Updates only carry an oldrev if new commits were pushed
+			if attrs.OldRev != "" {
+				event.Action = "synchronize"
+			} else {
+				event.Action = "edited"
+			}
+		case "close":
+			event.Action = "closed"
+		default:
+			event.Action = attrs.Action
+		}
+
+		event.Type = "pull_request"
+		event.Branch = attrs.SourceBranch
+		event.Commit = attrs.LastCommit.ID
+		event.Message = attrs.LastCommit.Message
+		event.BaseBranch = attrs.TargetBranch
+		event.Owner, event.Repo, err = splitProjectPath(attrs.Source.PathWithNamespace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		event.BaseOwner, event.BaseRepo, err = splitProjectPath(attrs.Target.PathWithNamespace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// We've built our Event - put it into the channel and we're done
+	go func() {
+		s.Events <- event
+	}()
+
+	w.Write([]byte(event.String()))
+}
+
+// gitlabProvider builds repositories hosted on a self-hosted GitLab server
+type gitlabProvider struct {
+	config   *ServerConfig
+	receiver *GitlabServer
+}
+
+// NewGitlabProvider creates the GitLab provider from the [gitlab] section of the config
+func NewGitlabProvider() Provider {
+	receiver := NewGitlabServer()
+	receiver.Secret = Config.Gitlab.Secret
+	return &gitlabProvider{config: &Config.Gitlab, receiver: receiver}
+}
+
+var gitlabStatuses = statusMap{
+	StatusPending:    "pending",
+	StatusRunning:    "running",
+	StatusSuccess:    "success",
+	StatusFailed:     "failed",
+	StatusFailedBoot: "failed",
+	StatusCancelled:  "canceled",
+	StatusTimedOut:   "failed",
+	StatusSuperseded: "canceled",
+	StatusSkipped:    "skipped",
+}
+
+func (p *gitlabProvider) Name() string   { return "GitLab" }
+func (p *gitlabProvider) Domain() string { return p.config.Domain }
+
+func (p *gitlabProvider) Webhook() (string, http.Handler) { return "/gitlab", p.receiver }
+func (p *gitlabProvider) Events() <-chan WebhookEvent     { return p.receiver.Events }
+
+func (p *gitlabProvider) CloneURL(e *Event) string {
+	if Config.HttpsClone {
+		return p.config.URL + "/" + e.Owner + "/" + e.Repo + ".git"
+	}
+	return sshCloneURL(e)
+}
+
+func (p *gitlabProvider) Checkout(e *Event, dir string) error {
+	return gitCheckout(e, p.CloneURL(e), dir)
+}
+
+func (p *gitlabProvider) TranslateStatus(status string) string {
+	return gitlabStatuses.Translate(status)
+}
+
+// Report posts the status of the event to the GitLab commit status API
+func (p *gitlabProvider) Report(e *Event) error {
+	// If gitlab token is not set, skip posting results
+	if p.config.Token == "" {
+		return nil
+	}
+
+	// Statuses are posted to the project the commit was pushed to
+	project := url.PathEscape(e.Owner + "/" + e.Repo)
+	form := url.Values{
+		"state":       {e.TranslateStatus()},
+		"target_url":  {e.FullURL()},
+		"description": {e.StatusDescription()},
+		"name":        {"deadci"},
+	}
+	if e.Type == "push" {
+		form.Set("ref", e.Branch)
+	}
+
+	req, err := http.NewRequest("POST", p.config.URL+"/api/v4/projects/"+project+"/statuses/"+e.Commit, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("PRIVATE-TOKEN", p.config.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("GitLab status update failed: " + resp.Status + " " + string(body))
+	}
+	return nil
+}
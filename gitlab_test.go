@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitProjectPath(t *testing.T) {
+	owner, repo, err := splitProjectPath("group/project")
+	if err != nil || owner != "group" || repo != "project" {
+		t.Errorf("group/project: got %q, %q, %v", owner, repo, err)
+	}
+
+	for _, path := range []string{"group/subgroup/project", "a/b/c/d"} {
+		_, _, err := splitProjectPath(path)
+		if err == nil || err.Error() != "Projects in nested groups are not supported: "+path {
+			t.Errorf("%s: expected nested groups to be rejected, got %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"", "project", "/project", "group/"} {
+		_, _, err := splitProjectPath(path)
+		if err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+}
+
+func TestGitlabReport(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		requests = append(requests, r)
+		forms = append(forms, r.PostForm)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	p := &gitlabProvider{config: &ServerConfig{URL: server.URL, Domain: "gitlab.test", Token: "t0ken"}}
+	Providers[p.Domain()] = p
+	defer delete(Providers, p.Domain())
+
+	states := map[string]string{
+		StatusPending:    "pending",
+		StatusRunning:    "running",
+		StatusSuccess:    "success",
+		StatusFailed:     "failed",
+		StatusFailedBoot: "failed",
+		StatusCancelled:  "canceled",
+		StatusTimedOut:   "failed",
+		StatusSuperseded: "canceled",
+		StatusSkipped:    "skipped",
+	}
+	for status, state := range states {
+		mu.Lock()
+		requests, forms = nil, nil
+		mu.Unlock()
+		e := &Event{Domain: "gitlab.test", Status: status}
+		e.Owner, e.Repo, e.Branch, e.Commit, e.Type = "group", "project", "main", "abc123", "push"
+		err := p.Report(e)
+		if err != nil {
+			t.Fatalf("%s: %v", status, err)
+		}
+		mu.Lock()
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", status, len(requests))
+		}
+		r, form := requests[0], forms[0]
+		mu.Unlock()
+		if r.Method != "POST" || r.URL.EscapedPath() != "/api/v4/projects/group%2Fproject/statuses/abc123" {
+			t.Errorf("%s: posted to %s %s", status, r.Method, r.URL.EscapedPath())
+		}
+		if r.Header.Get("PRIVATE-TOKEN") != "t0ken" {
+			t.Errorf("%s: PRIVATE-TOKEN is %q", status, r.Header.Get("PRIVATE-TOKEN"))
+		}
+		if form.Get("state") != state {
+			t.Errorf("%s: state is %q, want %q", status, form.Get("state"), state)
+		}
+		if form.Get("ref") != "main" || form.Get("name") != "deadci" || form.Get("target_url") != e.FullURL() {
+			t.Errorf("%s: unexpected form %v", status, form)
+		}
+	}
+
+	// Failures to post are returned
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	p.config.URL = missing.URL
+	e := &Event{Domain: "gitlab.test", Status: StatusSuccess}
+	e.Owner, e.Repo, e.Commit, e.Type = "group", "project", "abc123", "push"
+	if err := p.Report(e); err == nil {
+		t.Errorf("expected an error when GitLab doesn't accept the status")
+	}
+}
+
+func TestGitlabWebhook(t *testing.T) {
+	s := NewGitlabServer()
+	s.Secret = "s3cret"
+	push := `{"ref": "refs/heads/main", "checkout_sha": "abc123", "project": {"path_with_namespace": "group/project"},
+		"commits": [{"id": "abc123", "message": "Fix it [skip ci]"}]}`
+
+	post := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/gitlab", strings.NewReader(push))
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		if token != "" {
+			req.Header.Set("X-Gitlab-Token", token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := post(token); w.Code != http.StatusForbidden {
+			t.Errorf("token %q: got %d, want %d", token, w.Code, http.StatusForbidden)
+		}
+	}
+	select {
+	case event := <-s.Events:
+		t.Fatalf("a rejected webhook queued %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if w := post("s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case event := <-s.Events:
+		if event.Type != "push" || event.Owner != "group" || event.Repo != "project" || event.Branch != "main" ||
+			event.Commit != "abc123" || event.Message != "Fix it [skip ci]" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event was queued")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Labels describe what something that runs builds can offer, such as "docker" or "gpu". A build can only be run
+// by a worker or agent that has every label it needs, see the [labels] section of deadci.ini and "labels" in
+// .deadci.yml.
+
+// RequiredLabels returns the labels needed to build the event, sorted by name: those given for its repository
+// in deadci.ini, and those its .deadci.yml asks for
+func (e *Event) RequiredLabels() []string {
+	repo := e.Domain + "/" + e.Owner + "/" + e.Repo
+	labels := strings.Fields(e.Labels)
+	for label, patterns := range Config.Labels {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, repo); matched && !hasLabels(labels, []string{label}) {
+				labels = append(labels, label)
+				break
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// GuessLabels gives a new event the labels the last build of its branch needed, as its .deadci.yml most likely asks
+// for the same ones. This hands it straight to a worker that has them, rather than to one that has to queue it again.
+// The labels are corrected once the build has started.
+func (e *Event) GuessLabels() error {
+	last, err := DB.GetLastBuilt(e)
+	if err != nil || last == nil {
+		return err
+	}
+	e.Labels = last.Labels
+	return nil
+}
+
+// hasLabels checks that have includes every one of want
+func hasLabels(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phayes/hookserve/hookserve"
+)
+
+// LocalDomain is the domain that builds of bare repositories on this machine are listed under
+const LocalDomain = "local"
+
+// localProvider builds bare repositories stored under the [local] root on this machine
+type localProvider struct {
+	root string
+}
+
+// NewLocalProvider creates the local provider from the [local] section of the config
+func NewLocalProvider() Provider {
+	return &localProvider{root: Config.Local.Root}
+}
+
+func (p *localProvider) Name() string   { return "Local" }
+func (p *localProvider) Domain() string { return LocalDomain }
+
+// Local repositories are triggered by their post-receive hook rather than a webhook
+func (p *localProvider) Webhook() (string, http.Handler) { return "", nil }
+func (p *localProvider) Events() <-chan WebhookEvent     { return nil }
+
+// CloneURL returns the path of the bare repository, which may or may not end in .git
+func (p *localProvider) CloneURL(e *Event) string {
+	repoPath := filepath.Join(p.root, e.Owner, e.Repo)
+	if _, err := os.Stat(repoPath + ".git"); err == nil {
+		return repoPath + ".git"
+	}
+	return repoPath
+}
+
+func (p *localProvider) Checkout(e *Event, dir string) error {
+	return gitCheckout(e, p.CloneURL(e), dir)
+}
+
+func (p *localProvider) Report(e *Event) error { return nil }
+
+func (p *localProvider) TranslateStatus(status string) string { return status }
+
+// localRepo works out the owner and repo of a bare repository from its path under the [local] root
+func localRepo(repoPath string) (string, string, error) {
+	repoPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(Config.Local.Root, repoPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", "", errors.New(repoPath + " is not under the local root " + Config.Local.Root)
+	}
+	owner, repo, err := splitProjectPath(strings.TrimSuffix(filepath.ToSlash(rel), ".git"))
+	if err != nil {
+		return "", "", errors.New(repoPath + " must be stored as <owner>/<repo> under the local root " + Config.Local.Root)
+	}
+	return owner, repo, nil
+}
+
+// runTrigger implements `deadci trigger [repo-path branch commit]`.
+// It asks the running DeadCI server to build a commit of a local bare repository.
+// Without arguments it acts as a post-receive hook, building the branches pushed to the repository in the current directory.
+func runTrigger(args []string) {
+	if !Config.Local.Enabled {
+		fmt.Fprintln(os.Stderr, "deadci trigger: the [local] section of deadci.ini is not enabled")
+		os.Exit(1)
+	}
+
+	var repoPath string
+	var pushes [][2]string // branch and commit pairs
+	switch len(args) {
+	case 0:
+		// post-receive hooks are run inside the repository with "<oldrev> <newrev> <ref>" lines on stdin
+		repoPath = "."
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 || !strings.HasPrefix(fields[2], "refs/heads/") || strings.Trim(fields[1], "0") == "" {
+				continue
+			}
+			pushes = append(pushes, [2]string{fields[2][11:], fields[1]})
+		}
+	case 3:
+		repoPath = args[0]
+		pushes = append(pushes, [2]string{args[1], args[2]})
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: deadci trigger --data-dir=/path/to/data/dir [repo-path branch commit]")
+		os.Exit(2)
+	}
+
+	owner, repo, err := localRepo(repoPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deadci trigger: "+err.Error())
+		os.Exit(1)
+	}
+
+	// Queue the build by posting to it, the same as pressing the re-run button
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	failed := false
+	for _, push := range pushes {
+		event := Event{Domain: LocalDomain, Event: hookserve.Event{Owner: owner, Repo: repo, Branch: push[0], Commit: push[1]}}
+		resp, err := client.Post("http://localhost:"+strconv.Itoa(Config.Port)+"/"+event.Path(), "text/plain", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "deadci trigger: "+err.Error())
+			failed = true
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			fmt.Fprintln(os.Stderr, "deadci trigger: unable to queue "+event.Path()+": "+resp.Status)
+			failed = true
+			continue
+		}
+		fmt.Println("DeadCI build queued: " + event.FullURL())
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Build logs are kept in files under the data dir rather than in the database, named after the ID of their event
+// and the attempt at building it. A log is appended to logs/<id>-<run>.log while its event is built, and may be
+// compressed to logs/<id>-<run>.log.gz once it is finished.
+
+// logViewSize is how much of the end of a log is shown when viewing a build in the browser
+const logViewSize = 1 << 20
+
+// LogFile is the path of the uncompressed log of the event
+func (e *Event) LogFile() string {
+	return Config.DataDir + "/logs/" + strconv.Itoa(e.ID) + "-" + strconv.Itoa(e.RunNumber) + ".log"
+}
+
+// AppendLog adds output to the event log and sends it to anyone streaming the log
+func (e *Event) AppendLog(p []byte) error {
+	if e.remote != nil {
+		return e.remote.AppendLog(e, p)
+	}
+	f, err := e.openLogForWriting(os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p)
+	if err != nil {
+		return err
+	}
+	LogStreams.Publish(e.Path(), logChunk{Offset: int(info.Size()), Data: append([]byte{}, p...)})
+	return nil
+}
+
+// ResetLog replaces the event log, notifying anyone streaming the log
+func (e *Event) ResetLog(p []byte) error {
+	f, err := e.openLogForWriting(os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(p)
+	if err != nil {
+		return err
+	}
+	LogStreams.Publish(e.Path(), logChunk{Reset: true, Data: append([]byte{}, p...)})
+	return nil
+}
+
+// openLogForWriting opens the uncompressed log, uncompressing it first if the build is being added to after it finished
+func (e *Event) openLogForWriting(flag int) (*os.File, error) {
+	if e.ID == 0 {
+		return nil, errors.New("Cannot write the log of an event with no ID. Use Insert()")
+	}
+	if flag&os.O_TRUNC != 0 {
+		err := os.Remove(e.LogFile() + ".gz")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if _, err := os.Stat(e.LogFile()); os.IsNotExist(err) {
+		err = e.UncompressLog()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(e.LogFile(), os.O_WRONLY|os.O_CREATE|flag, 0644)
+}
+
+// ReadLog reads up to limit bytes of the log starting at offset. A negative limit reads to the end of the log.
+func (e *Event) ReadLog(offset, limit int) ([]byte, error) {
+	r, err := e.openLogForReading()
+	if err != nil || r == nil {
+		return nil, err
+	}
+	defer r.Close()
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err = seeker.Seek(int64(offset), io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r, int64(offset))
+	}
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 {
+		return ioutil.ReadAll(io.LimitReader(r, int64(limit)))
+	}
+	return ioutil.ReadAll(r)
+}
+
+// LogSize returns the length of the uncompressed log
+func (e *Event) LogSize() (int, error) {
+	if e.remote != nil {
+		return e.remote.logSize, nil
+	}
+	info, err := os.Stat(e.LogFile())
+	if err == nil {
+		return int(info.Size()), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	r, err := e.openLogForReading()
+	if err != nil || r == nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	return int(n), err
+}
+
+// OpenLog opens the log for serving over HTTP, returning nil if the event has no log yet
+func (e *Event) OpenLog() (io.ReadSeekCloser, time.Time, error) {
+	f, err := os.Open(e.LogFile())
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+		return f, info.ModTime(), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, time.Time{}, err
+	}
+
+	// Compressed logs are uncompressed in memory so that they can be read from anywhere
+	info, err := os.Stat(e.LogFile() + ".gz")
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	log, err := e.ReadLog(0, -1)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return nopCloser{bytes.NewReader(log)}, info.ModTime(), nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openLogForReading opens the log, compressed or not. Returns nil if the event has no log yet.
+func (e *Event) openLogForReading() (io.ReadCloser, error) {
+	f, err := os.Open(e.LogFile())
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err = os.Open(e.LogFile() + ".gz")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{gz, f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// CompressLog gzips the log of a finished build
+func (e *Event) CompressLog() error {
+	f, err := os.Open(e.LogFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := e.LogFile() + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, f)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Readers fall back to the compressed log once the uncompressed one is gone
+	err = os.Rename(tmp, e.LogFile()+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(e.LogFile())
+}
+
+// UncompressLog reverses CompressLog, so that more can be added to the log
+func (e *Event) UncompressLog() error {
+	r, err := e.openLogForReading()
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.Close()
+	tmp := e.LogFile() + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, e.LogFile())
+	if err != nil {
+		return err
+	}
+	return os.Remove(e.LogFile() + ".gz")
+}
+
+// DeleteLog removes the log of the event
+func (e *Event) DeleteLog() error {
+	for _, file := range []string{e.LogFile(), e.LogFile() + ".gz"} {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve the raw log of a single item. Range requests are supported, so clients can fetch just part of a long log.
+func handleLog(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
+	if len(path) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+	event, err := getItem(path, suffix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if proxyToNode(event, w, r) {
+		return
+	}
+
+	content, modtime, err := event.OpenLog()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if content == nil {
+		content = nopCloser{bytes.NewReader(nil)}
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if !IsFinal(event.Status) {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, "", modtime, content)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"html"
 	"log"
 	"net/http"
 	"os"
@@ -20,6 +22,13 @@ import (
 	"github.com/phayes/hookserve/hookserve"
 )
 
+// Subcommands are run instead of the server when named as the first argument
+var Subcommands = map[string]func(args []string){
+	"trigger": runTrigger,
+	"migrate": runMigrate,
+	"agent":   runAgent,
+}
+
 var (
 	ReRunMux   = sync.Mutex{}
 	InShutdown = false
@@ -28,18 +37,37 @@ var (
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// The sandbox executor re-executes us inside its namespaces. It needs no config.
+	if len(os.Args) > 1 && os.Args[1] == SandboxInitCommand {
+		sandboxInit(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if subcommand, ok := Subcommands[os.Args[1]]; ok {
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			InitConfig()
+			subcommand(flag.Args())
+			return
+		}
+	}
+
 	InitConfig()
 	InitDB()
-	InitANSI2HTML()
+	InitExecutor()
 	glog.Info("Starting up.")
+	InitProviders()
 	// Set up HTTP paths
-	githubreceive := hookserve.NewServer()
-	if Config.Github.Enabled {
-		githubreceive.Secret = Config.Github.Secret
-		http.Handle("/postreceive", githubreceive)
-		fmt.Println("Github webhook URL: http://" + Config.Host + ":" + strconv.Itoa(Config.Port) + "/postreceive")
+	for _, provider := range Providers {
+		path, receiver := provider.Webhook()
+		if receiver == nil {
+			continue
+		}
+		http.Handle(path, receiver)
+		fmt.Println(provider.Name() + " webhook URL: http://" + Config.Host + ":" + strconv.Itoa(Config.Port) + path)
 	}
 	http.HandleFunc("/", handleUI)
+	StartAgents()
 
 	// Listen and serve HTTP
 	go func() {
@@ -51,38 +79,8 @@ func main() {
 	}()
 
 	// Launch workers for running jobs
-	// We have a number of workers equal to the number of cores
-	for i := 1; i <= runtime.NumCPU(); i++ {
-		go func() {
-			for {
-				event, err := PopEvent()
-				if err != nil {
-					log.Println(err)
-				} else if event != nil {
-					err = event.Report()
-					if err != nil {
-						// If we can't update the status on the source-control system, then just log it and continue
-						event.Log = append(event.Log, []byte(err.Error()+"\n")...)
-						event.Update()
-						log.Println(err)
-					}
-					status, err := event.Run()
-					err = event.Finalize(status, err)
-					if err != nil {
-						log.Println(err)
-					}
-				}
-
-				// Wait 100 ms then check again
-				time.Sleep(100 * time.Millisecond)
-
-				// If we are shutting down, stop processing
-				if InShutdown {
-					return
-				}
-			}
-		}()
-	}
+	StartWorkers()
+	StartHeartbeat()
 
 	// Handle a sigint to gracefully shutdown
 	sigint := make(chan os.Signal, 1)
@@ -91,19 +89,26 @@ func main() {
 		for _ = range sigint {
 			fmt.Println("Got shutdown signal. Will shutdown when actively running jobs are finished. To shutdown immidaitely, use sigquit.")
 			InShutdown = true
-			// Wait until we have no running jobs then shut down.
+			// Wait until we have no running jobs then shut down. Finishing a build changes the queue.
+			// Matrix events waiting on jobs that are no longer going to be started here aren't waited for,
+			// nor are the builds of other servers sharing the database.
 			for {
-				numEvents, err := NumEvent("running")
+				changed := Queue.Changed()
+				building, err := DB.GetBuilding()
 				if err != nil {
 					log.Fatal(err)
 				}
-				if numEvents == 0 {
+				ours := 0
+				for i := range building {
+					if building[i].Node == Config.Database.Node {
+						ours++
+					}
+				}
+				if ours == 0 {
 					log.Println("Shutting down")
 					os.Exit(0)
-				} else {
-					// Wait 100 ms then check again
-					time.Sleep(100 * time.Millisecond)
 				}
+				<-changed
 			}
 		}
 	}()
@@ -114,49 +119,108 @@ func main() {
 	go func() {
 		for _ = range sigquit {
 			fmt.Println("Got quit signal. Shutting down immidaitely. To shutdown gracefully, use sigint.")
+			BuildExecutor.Shutdown()
 			os.Exit(1)
 		}
 	}()
 
 	// Add new events to the queue as they come in
-	for commit := range githubreceive.Events {
-		// Only run tets on pull-requests if there is new code to test
-		if commit.Type == "pull_request" && (commit.Action != "synchronize" && commit.Action != "opened") {
+	StartPoller()
+	for _, provider := range Providers {
+		if provider.Events() == nil {
 			continue
 		}
+		go func(provider Provider) {
+			for commit := range provider.Events() {
+				QueueEvent(commit, provider.Domain())
+			}
+		}(provider)
+	}
+	select {}
+}
 
-		event := Event{
-			Event:  commit,
-			Domain: "github.com", // For now we only support github
-			Status: StatusPending,
-			Time:   time.Now(),
-		}
-
-		// First check to see if the event already exists, and if it is reque it if it's not running
-		checkEvent, err := GetEvent(event.Domain, event.Owner, event.Repo, event.Branch, event.Commit)
+// QueueEvent adds an event received from a webhook to the queue
+func QueueEvent(commit WebhookEvent, domain string) {
+	// A pull request that was "updated" only has new code to test if its commit has moved on
+	if commit.Type == "pull_request" && commit.Action == "updated" {
+		last, err := DB.GetLastPullRequest(&Event{Event: commit.Event, Domain: domain})
 		if err != nil {
 			log.Println(err)
+			return
 		}
-		if checkEvent != nil {
-			// It's an old event, requeue it if we can
-			if checkEvent.Status != StatusRunning {
-				checkEvent.Status = StatusPending
-				err = checkEvent.Update()
-				if err != nil {
-					log.Println(err)
-				}
-				err = checkEvent.Report()
+		if last != nil && last.Commit == commit.Commit {
+			return
+		}
+		commit.Action = "synchronize"
+	}
+
+	// Only run tets on pull-requests if there is new code to test
+	if commit.Type == "pull_request" && (commit.Action != "synchronize" && commit.Action != "opened") {
+		return
+	}
+
+	event := Event{
+		Event:   commit.Event,
+		Domain:  domain,
+		Status:  StatusPending,
+		Time:    time.Now(),
+		Message: commit.Message,
+	}
+	event.Priority = event.RulePriority()
+
+	// First check to see if the event already exists, and if it is reque it if it's not running
+	checkEvent, err := GetEvent(event.Domain, event.Owner, event.Repo, event.Branch, event.Commit)
+	if err != nil {
+		log.Println(err)
+	}
+	if checkEvent != nil {
+		// It's an old event, requeue it if we can. A finished build is kept and built again as a new run.
+		// Skipped events stay skipped until they are re-run by hand.
+		if checkEvent.Status != StatusRunning && checkEvent.Status != StatusSkipped {
+			if IsFinal(checkEvent.Status) {
+				err = checkEvent.NewRun()
 				if err != nil {
 					log.Println(err)
+					return
 				}
+				checkEvent.Priority = event.Priority
 			}
-		} else {
-			// It's a new event, insert it anew
-			err = event.Insert()
+			checkEvent.Status = StatusPending
+			err = checkEvent.Update()
 			if err != nil {
 				log.Println(err)
 			}
-			err = event.Report()
+			err = checkEvent.Report()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	} else if reason := event.SkipReason(); reason != "" {
+		// It's a new event that the filters in deadci.ini leave out, record why it isn't built
+		err = event.Skip(reason)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	} else {
+		// It's a new event, insert it anew
+		err = event.GuessLabels()
+		if err != nil {
+			log.Println(err)
+		}
+		err = event.Insert()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		err = event.Report()
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Stop building older commits of the branch, they are no longer interesting
+		if Config.AutoCancel {
+			err = event.SupersedeEvents()
 			if err != nil {
 				log.Println(err)
 			}
@@ -168,15 +232,61 @@ func main() {
 func handleUI(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	path, err := parsePath(r.URL.Path)
+	path, suffix, err := parsePath(r.URL.Path)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
+	// Previous runs can only be looked at
+	if suffix.Run != 0 && r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Stream the log of a single item
+	if suffix.Action == "stream" {
+		if r.Method != "GET" {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleStream(path, suffix, w, r)
+		return
+	}
+
+	// Get the raw log of a single item
+	if suffix.Action == "log" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleLog(path, suffix, w, r)
+		return
+	}
+
+	// Cancel a pending or running item
+	if suffix.Action == "cancel" || r.Method == "DELETE" {
+		if r.Method != "POST" && r.Method != "DELETE" {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleCancel(path, suffix, w, r)
+		return
+	}
+
+	// Bump a pending item to the front of the queue
+	if suffix.Action == "bump" {
+		if r.Method != "POST" {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleBump(path, suffix, w, r)
+		return
+	}
+
 	// If it's a POST we re-run it
 	if r.Method == "POST" {
-		handleReRun(path, w, r)
+		handleReRun(path, suffix, w, r)
 		return
 	}
 
@@ -187,13 +297,13 @@ func handleUI(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(path) == 5 { // It's a single item
-		handleView(path, w, r)
+		handleView(path, suffix, w, r)
 	} else { // It's an index request
 		handleIndex(path, w, r)
 	}
 }
 
-func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
+func handleReRun(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
 	ReRunMux.Lock()
 	defer ReRunMux.Unlock()
 
@@ -202,15 +312,22 @@ func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	event, err := GetEvent(path[0], path[1], path[2], path[3], path[4])
+	event, err := GetJob(path[0], path[1], path[2], path[3], path[4], suffix.Job)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if event == nil && suffix.Job != 0 {
+		// Matrix jobs are only created by running their event
+		http.NotFound(w, r)
+		return
+	}
 	if event == nil {
-		// For now we only support github
-		if path[0] != "github.com" {
-			http.Error(w, "Only github.com currently supported", http.StatusInternalServerError)
+		// We can only build events for domains that have a provider
+		_, err := GetProvider(path[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
 
 		// Event doesn't exist, create it and mark pending to queue it
@@ -222,11 +339,28 @@ func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
 				Commit: path[4],
 				Type:   "push",
 			},
-			Domain: "github.com", // For now we only support github
+			Domain: path[0],
 			Status: StatusPending,
 			Time:   time.Now(),
 		}
-		err := event.Insert()
+		event.Priority = event.RulePriority()
+
+		// Branches the filters in deadci.ini leave out are recorded as skipped. Re-run them to build them anyway.
+		if reason := event.SkipReason(); reason != "" {
+			err = event.Skip(reason)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/"+event.Path(), http.StatusSeeOther)
+			return
+		}
+
+		err = event.GuessLabels()
+		if err != nil {
+			log.Println(err)
+		}
+		err = event.Insert()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -235,6 +369,12 @@ func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Println(err)
 		}
+		if Config.AutoCancel {
+			err = event.SupersedeEvents()
+			if err != nil {
+				log.Println(err)
+			}
+		}
 		http.Redirect(w, r, "/"+event.Path(), http.StatusSeeOther)
 	} else {
 		if event.Status == StatusRunning {
@@ -242,10 +382,23 @@ func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// We have the event, run it again
-		// Save it back to the database marked as running
-		event.Status = StatusRunning
-		event.Log = []byte("Retrying...\n")
+		// We have the event, run it again, keeping the previous run if it finished
+		if IsFinal(event.Status) {
+			err = event.NewRun()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			event.Priority = event.RerunPriority()
+		} else if priority := event.RerunPriority(); priority > event.Priority {
+			// Keep the priority of a pending item that has been bumped
+			event.Priority = priority
+		}
+
+		// Put it back in the queue, where a worker with the labels it needs takes it once it is within the limits
+		// in deadci.ini
+		event.Status = StatusPending
+		event.ResetLog([]byte("Retrying...\n"))
 		err := event.Update()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -256,31 +409,84 @@ func handleReRun(path []string, w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 		}
 
-		go func() {
-			status, err := event.Run()
-			err = event.Finalize(status, err)
-			if err != nil {
-				log.Println(err)
-			}
-		}()
-
 		http.Redirect(w, r, "/"+event.Path(), 303)
 	}
 }
 
-func handleView(path []string, w http.ResponseWriter, r *http.Request) {
-	event, err := GetEvent(path[0], path[1], path[2], path[3], path[4])
+func handleView(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
+	current, err := GetJob(path[0], path[1], path[2], path[3], path[4], suffix.Job)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if event == nil {
+	if current == nil {
 		http.NotFound(w, r)
 		return
 	}
+	event := current
+	if suffix.Run != 0 {
+		event, err = current.GetRun(suffix.Run)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if event == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if proxyToNode(event, w, r) {
+		return
+	}
+	past := event.RunNumber != current.RunNumber
+	itemPath := event.Path()
+	if past {
+		itemPath = event.RunPath()
+	}
+
+	// List all the attempts at building the item
+	event.Runs, err = current.GetRuns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.Runs = append(event.Runs, Run{Number: current.RunNumber, Status: current.Status, Time: current.Time})
+
+	// If the event was split into a matrix of jobs, list them. Jobs are only kept for the current run.
+	var jobs []Event
+	if event.Job == 0 && !past {
+		jobs, err = GetJobs(path[0], path[1], path[2], path[3], path[4])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only the end of a long log is shown, the rest can be fetched from /log
+	size, err := event.LogSize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	start := 0
+	if size > logViewSize {
+		start = size - logViewSize
+	}
+	event.Log, err = event.ReadLog(start, size-start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if start != 0 {
+		// Start at the beginning of a line
+		i := bytes.IndexByte(event.Log, '\n') + 1
+		event.Log = event.Log[i:]
+		start += i
+	}
 
 	if r.Header.Get("Accept") == "application/json" {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		event.Jobs = jobs
 		jbytes, err := json.MarshalIndent(event, " ", "  ")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -289,17 +495,52 @@ func handleView(path []string, w http.ResponseWriter, r *http.Request) {
 		w.Write(jbytes)
 	} else { // Serve HTML
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		ansi2html, err := ANSI2HTML(event.String())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+
+		// If the event is still going, only print complete lines. The rest will be streamed.
+		final := IsFinal(event.Status)
+		if !final {
+			event.Log = event.Log[:bytes.LastIndex(event.Log, []byte("\n"))+1]
 		}
 
 		// Print output
-		fmt.Fprintln(w, "<html><body class='f9 b9'>")
-		io.Copy(w, ansi2html)
-		if event.Status == StatusSuccess || event.Status == StatusFailed || event.Status == StatusFailedBoot {
-			fmt.Fprintln(w, "<form method='POST'><input type='submit' value='re-run'></form>")
+		fmt.Fprintln(w, "<html><body style='background-color:black; color:#AAAAAA'>")
+		if start != 0 {
+			fmt.Fprintln(w, "<p><a href='/"+html.EscapeString(itemPath)+"/log'>Full log</a>: the first "+strconv.Itoa(start)+" bytes are not shown</p>")
+		}
+		fmt.Fprintln(w, "<pre id='log'>")
+		err := ANSI2HTML(w, strings.NewReader(event.String()))
+		if err != nil {
+			log.Println(err)
+		}
+		fmt.Fprintln(w, "</pre>")
+		pending := event.Status == StatusPending
+		if len(jobs) != 0 {
+			fmt.Fprintln(w, "<table>")
+			for _, job := range jobs {
+				fmt.Fprintln(w, "<tr><td><a href='/"+job.Path()+"'>job "+strconv.Itoa(job.Job)+"</a></td><td>"+html.EscapeString(job.MatrixString())+"</td><td>"+job.Status+"</td></tr>")
+				pending = pending || job.Status == StatusPending
+			}
+			fmt.Fprintln(w, "</table>")
+		}
+		if len(event.Runs) > 1 {
+			fmt.Fprintln(w, "<table>")
+			for _, run := range event.Runs {
+				runPath := current.Path()
+				if run.Number != current.RunNumber {
+					runPath += "/runs/" + strconv.Itoa(run.Number)
+				}
+				fmt.Fprintln(w, "<tr><td><a href='/"+html.EscapeString(runPath)+"'>run "+strconv.Itoa(run.Number)+"</a></td><td>"+run.Time.String()+"</td><td>"+run.Status+"</td></tr>")
+			}
+			fmt.Fprintln(w, "</table>")
+		}
+		if final {
+			fmt.Fprintln(w, "<form method='POST' action='/"+html.EscapeString(event.Path())+"'><input type='submit' value='re-run'></form>")
+		} else {
+			fmt.Fprintln(w, "<form method='POST' action='/"+html.EscapeString(event.Path())+"/cancel'><input type='submit' value='cancel'></form>")
+			if pending {
+				fmt.Fprintln(w, "<form method='POST' action='/"+html.EscapeString(event.Path())+"/bump'><input type='submit' value='bump'></form>")
+			}
+			fmt.Fprintf(w, streamScript, start+len(event.Log))
 		}
 		fmt.Fprintln(w, "</body></html>")
 	}
@@ -333,8 +574,54 @@ func handleIndex(path []string, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func parsePath(path string) ([]string, error) {
+// getItem gets the event, matrix job or previous run addressed by the path. Returns nil if there is no such item.
+func getItem(path []string, suffix pathSuffix) (*Event, error) {
+	event, err := GetJob(path[0], path[1], path[2], path[3], path[4], suffix.Job)
+	if err != nil || event == nil || suffix.Run == 0 {
+		return event, err
+	}
+	return event.GetRun(suffix.Run)
+}
+
+// Actions that can be appended to the path of a single item
+var pathActions = map[string]bool{
+	"stream": true,
+	"log":    true,
+	"cancel": true,
+	"bump":   true,
+}
+
+// pathSuffix is the part of a request path that follows the commit of a single item
+type pathSuffix struct {
+	Job    int    // Matrix job number, 0 for the event itself
+	Run    int    // Number of a previous attempt at building the item, 0 for the current one
+	Action string // Action on the item, for example "stream"
+}
+
+// parsePath splits a request path into domain, owner, repo, branch and commit.
+// If the path addresses a matrix job (eg "/jobs/2"), a run (eg "/runs/3") or an action on a single item
+// (eg "/stream"), these are returned separately.
+func parsePath(path string) ([]string, pathSuffix, error) {
 	parts := strings.Split(path, "/")
+	suffix := pathSuffix{}
+	if numparts := len(parts); numparts > 6 && pathActions[parts[numparts-1]] {
+		suffix.Action = parts[numparts-1]
+		parts = parts[:numparts-1]
+	}
+	if numparts := len(parts); numparts > 7 && parts[numparts-2] == "runs" {
+		run, err := strconv.Atoi(parts[numparts-1])
+		if err == nil && run > 0 {
+			suffix.Run = run
+			parts = parts[:numparts-2]
+		}
+	}
+	if numparts := len(parts); numparts > 7 && parts[numparts-2] == "jobs" {
+		job, err := strconv.Atoi(parts[numparts-1])
+		if err == nil && job > 0 {
+			suffix.Job = job
+			parts = parts[:numparts-2]
+		}
+	}
 	// If we have more than 6 parts, then we are trying to access a branch with a slash in it
 	// as only part that is allowed to have a slash in it is the branch name
 	if numparts := len(parts); numparts > 6 {
@@ -350,12 +637,30 @@ func parsePath(path string) ([]string, error) {
 	// Filter illigal characters
 	for _, part := range parts {
 		if strings.ContainsAny(part, " \"\\\b\f\n\r\t\v") {
-			return nil, errors.New("Illigal character in path")
+			return nil, suffix, errors.New("Illigal character in path")
 		}
 	}
 	if len(parts) == 2 && parts[1] == "" {
-		return make([]string, 0), nil
+		return make([]string, 0), suffix, nil
 	} else {
-		return parts[1:], nil
+		return parts[1:], suffix, nil
 	}
 }
+
+// Script for the HTML view of a running item that appends lines to the log as they are produced
+const streamScript = `<script>
+var log = document.getElementById('log');
+var source = new EventSource(location.pathname + '/stream?offset=%d');
+source.onmessage = function(e) {
+	log.insertAdjacentHTML('beforeend', e.data + '\n');
+	window.scrollTo(0, document.body.scrollHeight);
+};
+source.addEventListener('reset', function(e) {
+	location.reload();
+});
+source.addEventListener('status', function(e) {
+	source.close();
+	location.reload();
+});
+</script>
+`
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxMatrixJobs is the largest number of jobs a build matrix may expand into
+const MaxMatrixJobs = 64
+
+// MatrixMux serializes updates to the aggregate status of matrix events
+var MatrixMux = sync.Mutex{}
+
+// MatrixConfig declares axes of environment variables. The build is run once for every combination of values.
+type MatrixConfig struct {
+	Env map[string][]string `yaml:"env"`
+}
+
+// Expand returns every combination of the matrix axes, url-encoded as KEY=value pairs.
+// Axes are combined in order of their names, and values in the order they are given.
+func (m *MatrixConfig) Expand() ([]string, error) {
+	if m == nil || len(m.Env) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(m.Env))
+	for key, values := range m.Env {
+		if len(values) == 0 {
+			return nil, errors.New("matrix: env " + key + " has no values")
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	combinations := []url.Values{url.Values{}}
+	for _, key := range keys {
+		next := make([]url.Values, 0, len(combinations)*len(m.Env[key]))
+		for _, combination := range combinations {
+			for _, value := range m.Env[key] {
+				c := url.Values{}
+				for k, v := range combination {
+					c[k] = v
+				}
+				c.Set(key, value)
+				next = append(next, c)
+			}
+		}
+		if len(next) > MaxMatrixJobs {
+			return nil, errors.New("matrix: expands to more than " + strconv.Itoa(MaxMatrixJobs) + " jobs")
+		}
+		combinations = next
+	}
+
+	matrix := make([]string, len(combinations))
+	for i, combination := range combinations {
+		matrix[i] = combination.Encode()
+	}
+	return matrix, nil
+}
+
+// MatrixValues returns the matrix values of a job in KEY=value form, sorted by name
+func (e *Event) MatrixValues() []string {
+	values, err := url.ParseQuery(e.Matrix)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, key+"="+values.Get(key))
+	}
+	return env
+}
+
+// MatrixEnviron returns the environment variables for a matrix job
+func (e *Event) MatrixEnviron() []string {
+	if e.Job == 0 {
+		return nil
+	}
+	return append(e.MatrixValues(), "DEADCI_JOB="+strconv.Itoa(e.Job))
+}
+
+// MatrixString describes the matrix values of a job for people to read
+func (e *Event) MatrixString() string {
+	return strings.Join(e.MatrixValues(), " ")
+}
+
+// expandMatrix queues a job for every combination of the matrix. The event stays running until they have all finished.
+// Jobs left over from a previous run of the event are reused.
+func (e *Event) expandMatrix(matrix []string) error {
+	if e.remote != nil {
+		return e.remote.ExpandMatrix(e, matrix)
+	}
+
+	MatrixMux.Lock()
+	defer MatrixMux.Unlock()
+
+	for i, values := range matrix {
+		job, err := GetJob(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit, i+1)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			job = &Event{
+				Event:  e.Event,
+				Domain: e.Domain,
+				Job:    i + 1,
+			}
+		}
+		if job.ID != 0 && IsFinal(job.Status) {
+			err = job.NewRun()
+		} else if job.ID != 0 {
+			err = job.ResetLog(nil)
+		}
+		if err != nil {
+			return err
+		}
+		job.Matrix = values
+		job.Labels = e.Labels
+		job.Priority = e.Priority
+		job.Status = StatusPending
+		job.Time = time.Now()
+		if job.ID == 0 {
+			err = job.Insert()
+		} else {
+			err = job.Update()
+		}
+		if err != nil {
+			return err
+		}
+		e.AppendLog([]byte("Queued job " + strconv.Itoa(job.Job) + ": " + job.MatrixString() + "\n"))
+	}
+	err := DeleteJobs(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit, len(matrix))
+	if err != nil {
+		return err
+	}
+
+	// Save while still holding the lock so jobs that finish quickly see the event as running
+	return e.Update()
+}
+
+// jobStatusRank orders the final statuses of jobs. The event takes the highest ranked status of its jobs.
+var jobStatusRank = map[string]int{
+	StatusSuccess:    0,
+	StatusSuperseded: 1,
+	StatusCancelled:  2,
+	StatusFailedBoot: 3,
+	StatusTimedOut:   4,
+	StatusFailed:     5,
+}
+
+// reportParent updates the aggregate status of the event a matrix job belongs to and reports it to the provider.
+// The event is running while any job is pending or running, and failed if any job failed.
+func (e *Event) reportParent() error {
+	MatrixMux.Lock()
+	defer MatrixMux.Unlock()
+
+	parent, err := GetEvent(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit)
+	if err != nil {
+		return err
+	}
+	jobs, err := GetJobs(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit)
+	if err != nil {
+		return err
+	}
+	if parent == nil || len(jobs) == 0 {
+		return errors.New("Unable to find matrix event for job " + e.Path())
+	}
+
+	status := StatusSuccess
+	summary := ""
+	for _, job := range jobs {
+		switch {
+		case !IsFinal(job.Status):
+			status = StatusRunning
+		case status == StatusRunning:
+		case jobStatusRank[job.Status] > jobStatusRank[status]:
+			status = job.Status
+		}
+		summary += "\njob " + strconv.Itoa(job.Job) + " (" + job.MatrixString() + "): " + job.Status
+	}
+	if status == parent.Status {
+		return nil
+	}
+
+	if IsFinal(status) {
+		parent.AppendLog([]byte("\n" + summary[1:] + "\n"))
+		return parent.Finalize(status, nil)
+	}
+	parent.Status = status
+	err = parent.Update()
+	if err != nil {
+		return err
+	}
+	return parent.Report()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A Migration is a change to the database schema. Each kind of database has its own list of migrations, see
+// Store.Migrations(). They are applied in order, each in its own transaction, and the version of the last one
+// applied is recorded in the schema_version table.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sqlx.Tx) error
+}
+
+const schemaVersionTableDef = `(
+	version INTEGER PRIMARY KEY,
+	description text NOT NULL,
+	applied timestamp NOT NULL
+)`
+
+// SchemaVersion returns the version of the last migration applied to the database
+func SchemaVersion() (int, error) {
+	exists, err := DB.HasTable("schema_version")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = DB.DB().Get(&version, "SELECT MAX(version) FROM schema_version")
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// PendingMigrations returns the migrations that have not yet been applied to the database
+func PendingMigrations() ([]Migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	migrations := DB.Migrations()
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return nil, errors.New("the database is at schema version " + strconv.Itoa(version) + " but this version of DeadCI only knows up to " + strconv.Itoa(latest) + ". Please upgrade DeadCI.")
+	}
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations to the database, calling applied after each one. Servers sharing the
+// database take turns, each looking for pending migrations once it has the lock.
+func Migrate(applied func(Migration)) error {
+	unlock, err := DB.LockSchema()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = DB.DB().Exec("CREATE TABLE IF NOT EXISTS schema_version " + schemaVersionTableDef)
+	if err != nil {
+		return err
+	}
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		tx, err := DB.DB().Beginx()
+		if err != nil {
+			return err
+		}
+		err = migration.Apply(tx)
+		if err == nil {
+			_, err = tx.Exec(tx.Rebind("INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)"), migration.Version, migration.Description, time.Now())
+		}
+		if err != nil {
+			tx.Rollback()
+			return errors.New("migration " + strconv.Itoa(migration.Version) + " (" + migration.Description + ") failed: " + err.Error())
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		if applied != nil {
+			applied(migration)
+		}
+	}
+	return nil
+}
+
+var migrateDryRun = flag.Bool("dry-run", false, "With the migrate subcommand, list the migrations that would be applied without applying them.")
+
+// runMigrate is run as `deadci migrate [--dry-run]`. It brings the database schema up to date, which the
+// server also does when it starts.
+func runMigrate(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: deadci migrate [--dry-run] [--data-dir=<dir>]")
+		os.Exit(2)
+	}
+	OpenDB()
+
+	version, err := SchemaVersion()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deadci migrate: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("Database schema is at version " + strconv.Itoa(version))
+
+	if *migrateDryRun {
+		pending, err := PendingMigrations()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "deadci migrate: "+err.Error())
+			os.Exit(1)
+		}
+		if len(pending) == 0 {
+			fmt.Println("Nothing to do")
+		}
+		for _, migration := range pending {
+			fmt.Println("Would apply " + strconv.Itoa(migration.Version) + ": " + migration.Description)
+		}
+		return
+	}
+
+	err = Migrate(func(migration Migration) {
+		fmt.Println("Applied " + strconv.Itoa(migration.Version) + ": " + migration.Description)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deadci migrate: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("Database schema is up to date")
+}
+
+// execAll executes each statement in turn, stopping at the first error
+func execAll(tx *sqlx.Tx, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
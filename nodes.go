@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+// Servers sharing a PostgreSQL database each take builds from the one queue. The server that takes a build records
+// itself as its node, by the address the others reach it at, and sends heartbeats while it runs the build. Should a
+// server go quiet its builds are queued again by the others. Stopping a build that another server is running
+// records its status and asks that server to stop it, see Event.stop(). Logs are written by the server building the
+// event, so requests for them are passed on to it unless the log is here too, as it is if the servers share the
+// data dir. Agents' reports on their builds are passed on to the server that handed the build out, which holds
+// the lease on it, see agent.go.
+
+// nodeHeartbeatInterval is how often a server lets the others know that it is still running its builds
+const nodeHeartbeatInterval = 10 * time.Second
+
+// nodeProxyHeader marks requests passed on by another server, so that they are never passed on again
+const nodeProxyHeader = "X-Deadci-Node"
+
+// StartHeartbeat keeps the builds of this server alive, and requeues those of servers that have gone quiet,
+// if the database is shared
+func StartHeartbeat() {
+	if Config.Database.Driver != "postgres" {
+		return
+	}
+	go func() {
+		for range time.Tick(nodeHeartbeatInterval) {
+			err := DB.Heartbeat()
+			if err != nil {
+				log.Println(err)
+			}
+			reaped, err := DB.Reap(Config.Database.Timeout)
+			if err != nil {
+				log.Println(err)
+			}
+			if reaped != 0 {
+				log.Println("Queued again " + strconv.Itoa(reaped) + " builds of servers that have not been heard from within " + Config.Database.Timeout.String())
+				notifyQueue()
+			}
+		}
+	}()
+}
+
+// proxyToNode passes a request for the log of the event on to the server that built it, unless the log is here.
+// Returns false if the request is to be handled here.
+func proxyToNode(e *Event, w http.ResponseWriter, r *http.Request) bool {
+	if !onOtherNode(e.Node, r) {
+		return false
+	}
+	// A running build's log is only streamed by the server running it
+	if IsFinal(e.Status) {
+		if f, err := e.openLogForReading(); err == nil && f != nil {
+			f.Close()
+			return false
+		}
+	}
+	forwardToNode(e.Node, w, r)
+	return true
+}
+
+// onOtherNode checks whether a request about a build on the node is for another server sharing the database to
+// handle. Requests already passed on by another server are always handled here.
+func onOtherNode(node string, r *http.Request) bool {
+	return Config.Database.Driver == "postgres" && node != "" && node != Config.Database.Node && r.Header.Get(nodeProxyHeader) == ""
+}
+
+// forwardToNode passes the request on to another server sharing the database
+func forwardToNode(node string, w http.ResponseWriter, r *http.Request) {
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = node
+			r.Header.Set(nodeProxyHeader, Config.Database.Node)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "The build is kept by "+node+", which can't be reached: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
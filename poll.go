@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/phayes/hookserve/hookserve"
+)
+
+// PollTimeout is how long a single `git ls-remote` may take
+const PollTimeout = time.Minute
+
+// A PollRepo is a remote repository that is polled for new commits instead of sending webhooks
+type PollRepo struct {
+	URL    string
+	Domain string
+	Owner  string
+	Repo   string
+}
+
+// ParsePollRepo works out the domain, owner and repo of a remote from its URL.
+// Both URLs (https://host/owner/repo.git) and scp-like addresses (git@host:owner/repo.git) are understood.
+func ParsePollRepo(remote string) (PollRepo, error) {
+	r := PollRepo{URL: remote}
+	var repoPath string
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return r, err
+		}
+		r.Domain, repoPath = u.Host, u.Path
+	} else if i := strings.Index(remote, ":"); i != -1 && !strings.Contains(remote[:i], "/") {
+		r.Domain, repoPath = remote[:i], remote[i+1:]
+		if at := strings.LastIndex(r.Domain, "@"); at != -1 {
+			r.Domain = r.Domain[at+1:]
+		}
+	}
+	if r.Domain == "" {
+		return r, errors.New("Unable to poll " + remote + ": remote must have a host")
+	}
+	var err error
+	r.Owner, r.Repo, err = splitProjectPath(strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git"))
+	if err != nil {
+		return r, errors.New("Unable to poll " + remote + ": " + err.Error())
+	}
+	return r, nil
+}
+
+// StartPoller polls the configured repositories for new commits until we shut down
+func StartPoller() {
+	if len(Config.Poll.Repos) == 0 {
+		return
+	}
+	go func() {
+		for !InShutdown {
+			for _, repo := range Config.Poll.Repos {
+				err := repo.Poll()
+				if err != nil {
+					log.Println(err)
+				}
+			}
+			time.Sleep(Config.Poll.Interval)
+		}
+	}()
+}
+
+// Poll lists the branch heads of the repository and queues any matching commits we haven't seen before
+func (r PollRepo) Poll() error {
+	ctx, cancel := context.WithTimeout(context.Background(), PollTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", r.URL)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.New("Unable to poll " + r.URL + ": " + err.Error())
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "refs/heads/") {
+			continue
+		}
+		commit, branch := fields[0], fields[1][11:]
+		if !PollBranchMatches(branch) {
+			continue
+		}
+
+		// Each head is only built once, after that it is up to people to re-run it
+		existing, err := GetEvent(r.Domain, r.Owner, r.Repo, branch, commit)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		QueueEvent(WebhookEvent{Event: hookserve.Event{
+			Type:   "push",
+			Owner:  r.Owner,
+			Repo:   r.Repo,
+			Branch: branch,
+			Commit: commit,
+		}}, r.Domain)
+	}
+	return scanner.Err()
+}
+
+// PollBranchMatches returns true if the branch matches one of the configured branch patterns
+func PollBranchMatches(branch string) bool {
+	for _, pattern := range Config.Poll.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pollProvider builds polled repositories on hosts that no other provider handles.
+// It clones from the polled URL and has nowhere to report statuses to.
+type pollProvider struct {
+	domain string
+	urls   map[string]string // Remote URLs keyed by owner/repo
+}
+
+// registerPollProviders makes sure every polled repository has a provider
+func registerPollProviders() {
+	for _, repo := range Config.Poll.Repos {
+		provider, err := GetProvider(repo.Domain)
+		if err != nil {
+			provider = &pollProvider{domain: repo.Domain, urls: map[string]string{}}
+			RegisterProvider(provider)
+		}
+		if p, ok := provider.(*pollProvider); ok {
+			p.urls[repo.Owner+"/"+repo.Repo] = repo.URL
+		}
+	}
+}
+
+func (p *pollProvider) Name() string   { return "Git" }
+func (p *pollProvider) Domain() string { return p.domain }
+
+// Polled repositories have no webhook
+func (p *pollProvider) Webhook() (string, http.Handler) { return "", nil }
+func (p *pollProvider) Events() <-chan WebhookEvent     { return nil }
+
+func (p *pollProvider) CloneURL(e *Event) string {
+	return p.urls[e.Owner+"/"+e.Repo]
+}
+
+func (p *pollProvider) Checkout(e *Event, dir string) error {
+	cloneURL := p.CloneURL(e)
+	if cloneURL == "" {
+		return errors.New(e.Domain + "/" + e.Owner + "/" + e.Repo + " is not a polled repository")
+	}
+	return gitCheckout(e, cloneURL, dir)
+}
+
+func (p *pollProvider) Report(e *Event) error { return nil }
+
+func (p *pollProvider) TranslateStatus(status string) string { return status }
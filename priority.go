@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"path"
+)
+
+// Workers take the pending event with the highest priority first, and the oldest of those when several share it.
+// An event gets its priority from the [priorities] section of deadci.ini when it is queued, re-runs by hand may
+// get rerunpriority instead, and anyone can bump a pending event to the front of the queue.
+
+// A PriorityRule gives a priority to the events of the branches matching any of its patterns. Patterns are of
+// <domain>/<owner>/<repo>/<branch>, as understood by path.Match.
+type PriorityRule struct {
+	Priority int
+	Patterns []string
+}
+
+// RulePriority returns the priority deadci.ini gives the event's branch: that of the highest rule matching it,
+// or 0 if none do
+func (e *Event) RulePriority() int {
+	branch := e.Domain + "/" + e.Owner + "/" + e.Repo + "/" + e.Branch
+	for _, rule := range Config.Priorities {
+		for _, pattern := range rule.Patterns {
+			if matched, _ := path.Match(pattern, branch); matched {
+				return rule.Priority
+			}
+		}
+	}
+	return 0
+}
+
+// RerunPriority returns the priority of the event when it is re-run by hand
+func (e *Event) RerunPriority() int {
+	priority := e.RulePriority()
+	if Config.RerunPriority > priority {
+		priority = Config.RerunPriority
+	}
+	return priority
+}
+
+// Bump moves the event to the front of the queue if it is pending. Bumping a matrix event bumps its pending jobs.
+// Returns false if there was nothing pending to bump.
+func (e *Event) Bump() (bool, error) {
+	priority, err := DB.MaxPriority()
+	if err != nil {
+		return false, err
+	}
+	priority++
+
+	events := []Event{*e}
+	if e.Job == 0 {
+		jobs, err := GetJobs(e.Domain, e.Owner, e.Repo, e.Branch, e.Commit)
+		if err != nil {
+			return false, err
+		}
+		events = append(events, jobs...)
+	}
+	bumped := false
+	for i := range events {
+		// Only pending events are changed, so that we don't race with a worker taking one
+		ok, err := DB.SetPriority(&events[i], priority)
+		if err != nil {
+			return false, err
+		}
+		bumped = bumped || ok
+	}
+	if bumped {
+		e.Priority = priority
+	}
+	return bumped, nil
+}
+
+// Bump a pending item to the front of the queue, then show it
+func handleBump(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
+	if len(path) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+
+	event, err := GetJob(path[0], path[1], path[2], path[3], path[4], suffix.Job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	bumped, err := event.Bump()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !bumped {
+		http.Error(w, "Unable to bump item that is not pending", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/"+event.Path(), http.StatusSeeOther)
+}
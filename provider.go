@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/phayes/hookserve/hookserve"
+)
+
+// A Provider is a source-control host that DeadCI builds repositories for.
+// Adding support for a new host is a matter of implementing Provider and registering it in InitProviders.
+type Provider interface {
+	Name() string                    // Name of the host for people to read, for example "GitHub"
+	Domain() string                  // Domain that events for this provider are listed under
+	Webhook() (string, http.Handler) // Path to serve the webhook receiver on, and the receiver
+	Events() <-chan WebhookEvent     // Events received by the webhook receiver
+	CloneURL(e *Event) string        // URL to clone the repository of the event from
+	Checkout(e *Event, dir string) error
+	Report(e *Event) error                // Post the status of the event back to the host
+	TranslateStatus(status string) string // Translate a DeadCI status into the host's own
+}
+
+// A WebhookEvent is an event received by a provider's webhook receiver
+type WebhookEvent struct {
+	hookserve.Event
+	Message string // Message of the commit, if the webhook carries it
+}
+
+// ErrUnknownProvider is returned for events whose domain no enabled provider handles
+type ErrUnknownProvider struct {
+	Domain string
+}
+
+func (err ErrUnknownProvider) Error() string {
+	return "No source-control provider is configured for " + err.Domain
+}
+
+// Providers holds the enabled providers, keyed by domain
+var Providers = map[string]Provider{}
+
+// RegisterProvider adds a provider to the registry
+func RegisterProvider(p Provider) {
+	if _, ok := Providers[p.Domain()]; ok {
+		log.Fatal("More than one provider is configured for " + p.Domain())
+	}
+	Providers[p.Domain()] = p
+}
+
+// GetProvider returns the provider for a domain, or ErrUnknownProvider
+func GetProvider(domain string) (Provider, error) {
+	p, ok := Providers[domain]
+	if !ok {
+		return nil, ErrUnknownProvider{domain}
+	}
+	return p, nil
+}
+
+// InitProviders registers the providers enabled in the config
+func InitProviders() {
+	if Config.Github.Enabled {
+		RegisterProvider(NewGithubProvider())
+	}
+	if Config.Gitlab.Enabled {
+		RegisterProvider(NewGitlabProvider())
+	}
+	if Config.Gitea.Enabled {
+		RegisterProvider(NewGiteaProvider())
+	}
+	if Config.Bitbucket.Enabled {
+		RegisterProvider(NewBitbucketProvider())
+	}
+	if Config.Local.Enabled {
+		RegisterProvider(NewLocalProvider())
+	}
+	registerPollProviders()
+}
+
+// A statusMap translates DeadCI statuses into those of a provider
+type statusMap map[string]string
+
+// Translate a status. Statuses the provider has no equivalent for are passed through.
+func (m statusMap) Translate(status string) string {
+	translated, ok := m[status]
+	if !ok {
+		return status
+	}
+	return translated
+}
+
+// sshCloneURL returns the git+ssh URL for an event with the usual "git@host:owner/repo.git" layout
+func sshCloneURL(e *Event) string {
+	return "git@" + strings.Split(e.Domain, ":")[0] + ":" + e.Owner + "/" + e.Repo + ".git"
+}
+
+// gitCheckout clones the repository of the event into dir and checks out the event's commit
+func gitCheckout(e *Event, cloneURL, dir string) error {
+	glog.Info("Cloning repositories." + e.Owner + "/" + e.Repo)
+	glog.Info("temp directory: " + dir)
+	steps := [][]string{
+		{"git", "clone", cloneURL, dir},
+		{"git", "-C", dir, "checkout", "-q", e.Branch},
+		{"git", "-C", dir, "reset", "-q", "--hard", e.Commit},
+	}
+	for _, step := range steps {
+		out, err := exec.Command(step[0], step[1:]...).CombinedOutput()
+		e.AppendLog(out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
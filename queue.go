@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queueRetryInterval is how long a worker waits before trying again when the queue can't be read
+const queueRetryInterval = time.Second
+
+// Queue wakes workers waiting for something to build when the queue changes. The database stays the record
+// of what is queued: this only saves looking at it when nothing has changed.
+var Queue = &queueNotifier{changed: make(chan struct{})}
+
+type queueNotifier struct {
+	sync.Mutex
+	changed chan struct{}
+}
+
+// Changed returns a channel that is closed the next time the queue changes. Get it before looking at the queue,
+// so that a change made while looking isn't missed.
+func (q *queueNotifier) Changed() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+	return q.changed
+}
+
+// Notify wakes everyone waiting for the queue to change
+func (q *queueNotifier) Notify() {
+	q.Lock()
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.Unlock()
+}
+
+// notifyQueue tells the workers of this server, and of any others sharing the database, that an event has been
+// queued or a build has finished
+func notifyQueue() {
+	Queue.Notify()
+	err := DB.Notify()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// A WorkerPool is a number of workers on this server that build events, with the labels they offer.
+// Workers take any pending event they have the labels for, highest priority first, see priority.go.
+type WorkerPool struct {
+	Name    string
+	Workers int
+	Labels  []string
+}
+
+// WorkerPools returns the default pool, which has no labels, followed by the pools in the [pools] section of deadci.ini
+func WorkerPools() []WorkerPool {
+	return append([]WorkerPool{{Name: "default", Workers: Config.Workers}}, Config.Pools...)
+}
+
+// StartWorkers launches the workers of every pool
+func StartWorkers() {
+	for _, pool := range WorkerPools() {
+		if pool.Workers == 0 {
+			continue
+		}
+		log.Println("Starting " + strconv.Itoa(pool.Workers) + " workers in pool " + pool.Name)
+		for i := 1; i <= pool.Workers; i++ {
+			go pool.work()
+		}
+	}
+}
+
+// work builds events from the queue until we are shutting down, waiting for the queue to change when
+// there is nothing it can build
+func (pool WorkerPool) work() {
+	for !InShutdown {
+		changed := Queue.Changed()
+		event, err := PopEvent(acceptEvents(pool.Labels))
+		if err != nil {
+			log.Println(err)
+			time.Sleep(queueRetryInterval)
+			continue
+		}
+		if event == nil {
+			<-changed
+			continue
+		}
+
+		err = event.Report()
+		if err != nil {
+			// If we can't update the status on the source-control system, then just log it and continue
+			event.AppendLog([]byte(err.Error() + "\n"))
+			event.Update()
+			log.Println(err)
+		}
+		status, err := event.Run(pool.Labels)
+		err = event.Finalize(status, err)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// acceptEvents returns a filter for PopEvent that accepts the events that can be built with the given labels
+func acceptEvents(labels []string) func(*Event) bool {
+	return func(e *Event) bool {
+		return hasLabels(labels, e.RequiredLabels())
+	}
+}
+
+// hasBuildLimits checks whether deadci.ini limits how many builds of a repository or owner run at once
+func hasBuildLimits() bool {
+	return Config.MaxRepoBuilds != 0 || Config.MaxOwnerBuilds != 0
+}
+
+// withinBuildLimits adds the limits on concurrent builds in deadci.ini to accept, given the events being built.
+// Stores count the builds while holding the queue, so that the limits hold across servers sharing the database.
+func withinBuildLimits(building []Event, accept func(*Event) bool) func(*Event) bool {
+	counts := make(map[string]int)
+	for _, running := range building {
+		counts[running.Domain+"/"+running.Owner]++
+		counts[running.Domain+"/"+running.Owner+"/"+running.Repo]++
+	}
+	return func(e *Event) bool {
+		if Config.MaxOwnerBuilds != 0 && counts[e.Domain+"/"+e.Owner] >= Config.MaxOwnerBuilds {
+			return false
+		}
+		if Config.MaxRepoBuilds != 0 && counts[e.Domain+"/"+e.Owner+"/"+e.Repo] >= Config.MaxRepoBuilds {
+			return false
+		}
+		return accept(e)
+	}
+}
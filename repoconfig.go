@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepoConfigFile is the name of the per-repository build configuration file, found at the root of the repository
+const RepoConfigFile = ".deadci.yml"
+
+// RepoConfig is the build configuration for a single repository.
+// Any setting not given in .deadci.yml falls back to the global setting in deadci.ini.
+type RepoConfig struct {
+	Steps    []string          `yaml:"steps"`    // Shell commands to run in order. If empty the global command is run.
+	Env      map[string]string `yaml:"env"`      // Extra environment variables
+	Timeout  string            `yaml:"timeout"`  // Maximum time for the build, for example "10m"
+	WorkDir  string            `yaml:"workdir"`  // Directory relative to the repository root in which to run the build
+	Matrix   *MatrixConfig     `yaml:"matrix"`   // Run the build once for each combination of these values
+	Image    string            `yaml:"image"`    // Container image to build in, when builds are run in containers
+	Labels   []string          `yaml:"labels"`   // Labels whatever runs the build must have, such as "docker"
+	Branches Filter            `yaml:"branches"` // Branches to build
+	Paths    Filter            `yaml:"paths"`    // Files whose changes trigger builds
+
+	timeout time.Duration
+}
+
+// LoadRepoConfig reads .deadci.yml from the given repository directory.
+// If the repository has no .deadci.yml then nil is returned with no error.
+func LoadRepoConfig(repoDir string) (*RepoConfig, error) {
+	data, err := ioutil.ReadFile(repoDir + "/" + RepoConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ParseRepoConfig(data)
+}
+
+// ParseRepoConfig parses and validates the contents of a .deadci.yml file
+func ParseRepoConfig(data []byte) (*RepoConfig, error) {
+	rc := RepoConfig{}
+	err := yaml.UnmarshalStrict(data, &rc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, step := range rc.Steps {
+		rc.Steps[i] = strings.TrimSpace(step)
+		if rc.Steps[i] == "" {
+			return nil, errors.New("steps: step " + strconv.Itoa(i+1) + " is empty")
+		}
+	}
+
+	if rc.Timeout != "" {
+		rc.timeout, err = time.ParseDuration(rc.Timeout)
+		if err != nil {
+			return nil, errors.New("timeout: " + err.Error())
+		}
+		if rc.timeout <= 0 {
+			return nil, errors.New("timeout: must be greater than zero")
+		}
+	}
+
+	if rc.WorkDir != "" {
+		clean := filepath.Clean(rc.WorkDir)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, errors.New("workdir: must be a directory inside the repository")
+		}
+		rc.WorkDir = clean
+	}
+
+	for key := range rc.Env {
+		if key == "" || strings.ContainsAny(key, "= \t\n") {
+			return nil, errors.New("env: invalid variable name \"" + key + "\"")
+		}
+	}
+
+	for i, label := range rc.Labels {
+		rc.Labels[i] = strings.ToLower(strings.TrimSpace(label))
+		if rc.Labels[i] == "" || strings.ContainsAny(rc.Labels[i], " \t\n") {
+			return nil, errors.New("labels: invalid label \"" + label + "\"")
+		}
+	}
+
+	if err = rc.Branches.Validate(); err != nil {
+		return nil, errors.New("branches: " + err.Error())
+	}
+	if err = rc.Paths.Validate(); err != nil {
+		return nil, errors.New("paths: " + err.Error())
+	}
+
+	_, err = rc.Matrix.Expand()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+// MatrixJobs returns the matrix values of each job the build should be split into, if any
+func (rc *RepoConfig) MatrixJobs() []string {
+	if rc == nil {
+		return nil
+	}
+	// The matrix has already been validated by ParseRepoConfig
+	matrix, _ := rc.Matrix.Expand()
+	return matrix
+}
+
+// Commands returns the commands to run for the build, falling back to the global command
+func (rc *RepoConfig) Commands() [][]string {
+	if rc == nil || len(rc.Steps) == 0 {
+		if len(Config.Command) == 0 {
+			return nil
+		}
+		return [][]string{Config.Command}
+	}
+	commands := make([][]string, len(rc.Steps))
+	for i, step := range rc.Steps {
+		commands[i] = []string{"sh", "-c", step}
+	}
+	return commands
+}
+
+// Environ returns the extra environment variables in KEY=value form, sorted by name
+func (rc *RepoConfig) Environ() []string {
+	if rc == nil {
+		return nil
+	}
+	env := make([]string, 0, len(rc.Env))
+	for key, value := range rc.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// GetTimeout returns the build timeout, falling back to the global timeout. Zero means there is none.
+func (rc *RepoConfig) GetTimeout() time.Duration {
+	if rc == nil || rc.timeout == 0 {
+		return Config.Timeout
+	}
+	return rc.timeout
+}
+
+// GetWorkDir returns the directory, relative to the root of the repository, that the build should run in
+func (rc *RepoConfig) GetWorkDir() string {
+	if rc == nil {
+		return ""
+	}
+	return rc.WorkDir
+}
+
+// GetImage returns the container image to build in, falling back to the global image
+func (rc *RepoConfig) GetImage() string {
+	if rc == nil || rc.Image == "" {
+		return Config.Docker.Image
+	}
+	return rc.Image
+}
+
+// GetLabels returns the labels whatever runs the build must have, sorted by name
+func (rc *RepoConfig) GetLabels() []string {
+	if rc == nil {
+		return nil
+	}
+	labels := append([]string{}, rc.Labels...)
+	sort.Strings(labels)
+	return labels
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// A Run is a previous attempt at building an event. The current attempt is the event itself.
+// Each attempt keeps its own log, see LogFile().
+type Run struct {
+	ID     int       `json:"-"`
+	Event  int       `json:"-"` // ID of the event
+	Number int       `db:"run" json:"run"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// NewRun keeps the current attempt at building the event as a Run and starts the next one with an empty log.
+// The caller sets the status of the new attempt and saves the event.
+func (e *Event) NewRun() error {
+	if e.ID == 0 {
+		return errors.New("Cannot start a new run of an event with no ID. Use Insert()")
+	}
+	err := DB.InsertRun(&Run{Event: e.ID, Number: e.RunNumber, Status: e.Status, Time: e.Time})
+	if err != nil {
+		return err
+	}
+	e.RunNumber++
+	e.Time = time.Now()
+	LogStreams.Publish(e.Path(), logChunk{Reset: true})
+	return nil
+}
+
+// GetRuns gets the previous attempts at building the event, oldest first
+func (e *Event) GetRuns() ([]Run, error) {
+	return DB.GetRuns(e.ID)
+}
+
+// GetRun gets an attempt at building the event, as the event looked at the time.
+// Returns nil if there is no such attempt.
+func (e *Event) GetRun(number int) (*Event, error) {
+	if number == e.RunNumber {
+		return e, nil
+	}
+	run, err := DB.GetRun(e.ID, number)
+	if err != nil || run == nil {
+		return nil, err
+	}
+	past := *e
+	past.RunNumber = run.Number
+	past.Status = run.Status
+	past.Time = run.Time
+	return &past, nil
+}
+
+// RunPath is the path of this attempt at building the event
+func (e *Event) RunPath() string {
+	return e.Path() + "/runs/" + strconv.Itoa(e.RunNumber)
+}
+
+// DeleteRuns deletes the previous attempts at building the event, along with their logs
+func (e *Event) DeleteRuns() error {
+	runs, err := e.GetRuns()
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		past := Event{ID: e.ID, RunNumber: run.Number}
+		err = past.DeleteLog()
+		if err != nil {
+			return err
+		}
+	}
+	return DB.DeleteRuns(e.ID)
+}
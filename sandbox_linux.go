@@ -0,0 +1,271 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// SandboxExecutor runs build commands in new user, mount, pid and optionally network namespaces.
+// The host is visible read-only except for the checkout, and /tmp is private to the build.
+type SandboxExecutor struct{}
+
+// NewSandboxExecutor creates a SandboxExecutor
+func NewSandboxExecutor() (*SandboxExecutor, error) {
+	return &SandboxExecutor{}, nil
+}
+
+func (SandboxExecutor) Command(e *Event, step BuildStep) (*exec.Cmd, func(), error) {
+	args := []string{SandboxInitCommand, step.RepoDir, filepath.Join(step.RepoDir, step.WorkDir), strconv.FormatBool(Config.Sandbox.Network), "--"}
+	cmd := exec.Command("/proc/self/exe", append(args, step.Command...)...)
+
+	// The home directory is read-only inside the sandbox, so builds get a scratch one
+	cmd.Env = append(os.Environ(), "HOME=/tmp")
+	cmd.Env = append(cmd.Env, step.Env...)
+
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		// sandbox-init needs CAP_SYS_ADMIN in the new namespaces to set up its mounts. It drops it before running the build.
+		AmbientCaps: []uintptr{capSysAdmin},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	if !Config.Sandbox.Network {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return cmd, func() {}, nil
+}
+
+// Killing the build kills the whole pid namespace, so there is nothing left to clean up
+func (SandboxExecutor) Shutdown() {}
+
+const (
+	capSysAdmin             = 21
+	prCapBSetDrop           = 24
+	prSetNoNewPrivs         = 38
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// sandboxInit is run as `deadci sandbox-init <repo-dir> <work-dir> <network> -- <command>...` inside the new namespaces.
+// It sets up the sandbox's view of the filesystem and then executes the build command in its place.
+func sandboxInit(args []string) {
+	err := setupSandbox(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func setupSandbox(args []string) error {
+	// Capabilities are per thread, so stay on the one that drops them and executes the build
+	runtime.LockOSThread()
+
+	if len(args) < 5 || args[3] != "--" {
+		return errors.New("usage: deadci " + SandboxInitCommand + " <repo-dir> <work-dir> <network> -- <command>...")
+	}
+	repoDir, workDir, command := args[0], args[1], args[4:]
+	network, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return err
+	}
+
+	// Keep our mounts to ourselves
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return errors.New("unable to make mounts private: " + err.Error())
+	}
+
+	// Hold on to the checkout, it may be hidden by the private /tmp
+	repoFd, err := syscall.Open(repoDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.New("unable to open " + repoDir + ": " + err.Error())
+	}
+
+	// Make the host read-only
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.point == "/proc" || strings.HasPrefix(m.point, "/proc/") {
+			continue // Replaced below
+		}
+		err = syscall.Mount("", m.point, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|m.flags, "")
+		if err != nil {
+			return errors.New("unable to make " + m.point + " read-only: " + err.Error())
+		}
+	}
+
+	// Private /tmp, and a /proc for our pid namespace
+	err = syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	if err != nil {
+		return errors.New("unable to mount /tmp: " + err.Error())
+	}
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return errors.New("unable to mount /proc: " + err.Error())
+	}
+
+	// Make the checkout writable again
+	err = os.MkdirAll(repoDir, 0777)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("/proc/self/fd/"+strconv.Itoa(repoFd), repoDir, "", syscall.MS_BIND, "")
+	if err != nil {
+		return errors.New("unable to mount " + repoDir + ": " + err.Error())
+	}
+	err = syscall.Mount("", repoDir, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return errors.New("unable to make " + repoDir + " writable: " + err.Error())
+	}
+	syscall.Close(repoFd)
+
+	// Without the host network builds still get a loopback interface
+	if !network {
+		err = loopbackUp()
+		if err != nil {
+			return errors.New("unable to bring up loopback interface: " + err.Error())
+		}
+	}
+
+	err = os.Chdir(workDir)
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+
+	err = dropCapabilities()
+	if err != nil {
+		return errors.New("unable to drop capabilities: " + err.Error())
+	}
+	return syscall.Exec(path, command, os.Environ())
+}
+
+// dropCapabilities gives up every capability for good, so the build can't undo the sandbox.
+// This matters when DeadCI runs as root, as root keeps its capabilities across exec.
+func dropCapabilities() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	for c := uintptr(0); c < 64; c++ {
+		_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, c, 0)
+		if errno == syscall.EINVAL {
+			break // Past the last capability the kernel knows about
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	data := [2]struct{ effective, permitted, inheritable uint32 }{}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type sandboxMount struct {
+	point string
+	flags uintptr // Per-mount flags that must be kept when remounting
+}
+
+// mountFlags are the per-mount options that may be locked, and so must be given again when remounting
+var mountFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// readMounts lists the mounts visible to us from /proc/self/mountinfo
+func readMounts() ([]sandboxMount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []sandboxMount{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		m := sandboxMount{point: unescapeMountPoint(fields[4])}
+		for _, option := range strings.Split(fields[5], ",") {
+			m.flags |= mountFlags[option]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes used for whitespace and backslashes in mountinfo
+func unescapeMountPoint(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
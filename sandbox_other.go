@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SandboxExecutor is only available on Linux
+type SandboxExecutor struct {
+	HostExecutor
+}
+
+// NewSandboxExecutor fails everywhere but Linux, where namespaces are available
+func NewSandboxExecutor() (*SandboxExecutor, error) {
+	return nil, errors.New("the sandbox executor is only supported on Linux")
+}
+
+func sandboxInit(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox: only supported on Linux")
+	os.Exit(1)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogStreams fans out log output from running events to anyone watching them
+var LogStreams = &logBroker{subs: make(map[string]map[chan logChunk]bool)}
+
+// A logChunk is a piece of log output, a log reset, or a status change
+type logChunk struct {
+	Offset int    // Offset in the log at which Data starts
+	Data   []byte // Log data
+	Reset  bool   // The log has been replaced, Data starts a new log
+	Status string // The event has changed status
+}
+
+type logBroker struct {
+	sync.Mutex
+	subs map[string]map[chan logChunk]bool
+}
+
+// Subscribe to log chunks for the event at the given path
+func (b *logBroker) Subscribe(path string) chan logChunk {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan logChunk, 256)
+	if b.subs[path] == nil {
+		b.subs[path] = make(map[chan logChunk]bool)
+	}
+	b.subs[path][ch] = true
+	return ch
+}
+
+// Unsubscribe a channel previously returned by Subscribe
+func (b *logBroker) Unsubscribe(path string, ch chan logChunk) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subs[path][ch] {
+		delete(b.subs[path], ch)
+		close(ch)
+	}
+	if len(b.subs[path]) == 0 {
+		delete(b.subs, path)
+	}
+}
+
+// Publish a chunk to all subscribers of the event at the given path.
+// Subscribers that are not keeping up are dropped and will need to reconnect.
+func (b *logBroker) Publish(path string, chunk logChunk) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subs[path] {
+		select {
+		case ch <- chunk:
+		default:
+			delete(b.subs[path], ch)
+			close(ch)
+		}
+	}
+}
+
+// IsFinal returns true if the status is one that an event will not move on from without being re-run
+func IsFinal(status string) bool {
+	switch status {
+	case StatusSuccess, StatusFailed, StatusFailedBoot, StatusCancelled, StatusTimedOut, StatusSuperseded, StatusSkipped:
+		return true
+	}
+	return false
+}
+
+// Stream the log of a single event using Server-Sent Events.
+// Each message is one line of the log rendered as HTML, with the ID being the offset in the raw log
+// after the line. Clients may resume from an offset with the Last-Event-ID header or the offset
+// query parameter. Once the event reaches a final status a "status" event is sent and the stream ends.
+func handleStream(path []string, suffix pathSuffix, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	offset := 0
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("offset")
+	}
+	if lastID != "" {
+		var err error
+		offset, err = strconv.Atoi(lastID)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset "+lastID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before loading the event so we don't miss anything produced in between
+	key := strings.Join(path, "/")
+	if suffix.Job != 0 {
+		key += "/jobs/" + strconv.Itoa(suffix.Job)
+	}
+	chunks := LogStreams.Subscribe(key)
+	defer LogStreams.Unsubscribe(key, chunks)
+
+	event, err := getItem(path, suffix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if proxyToNode(event, w, r) {
+		return
+	}
+	size, err := event.LogSize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset > size {
+		offset = size
+	}
+	log, err := event.ReadLog(offset, -1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "retry: 1000\n\n")
+
+	s := &sseLog{w: w, offset: offset}
+	s.write(log)
+	if IsFinal(event.Status) {
+		s.finish(event.Status)
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				// We fell behind, the client will reconnect and resume
+				return
+			}
+			switch {
+			case chunk.Reset:
+				s.reset()
+				s.write(chunk.Data)
+			case chunk.Status != "":
+				if IsFinal(chunk.Status) {
+					s.finish(chunk.Status)
+					flusher.Flush()
+					return
+				}
+			case chunk.Offset > s.received():
+				// We've missed some output, make the client reconnect and resume
+				return
+			case chunk.Offset+len(chunk.Data) > s.received():
+				s.write(chunk.Data[s.received()-chunk.Offset:])
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sseLog writes log data as Server-Sent Events, one message per complete line
+type sseLog struct {
+	w       http.ResponseWriter
+	offset  int    // Offset in the raw log of the start of partial
+	partial []byte // Incomplete line that hasn't been sent yet
+	html    bytes.Buffer
+	conv    *ANSIConverter
+}
+
+// received is the offset in the raw log up to which we have data
+func (s *sseLog) received() int {
+	return s.offset + len(s.partial)
+}
+
+func (s *sseLog) write(p []byte) {
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i == -1 {
+			return
+		}
+		s.send(s.partial[:i+1])
+		s.partial = s.partial[i+1:]
+	}
+}
+
+func (s *sseLog) send(line []byte) {
+	if s.conv == nil {
+		s.conv = NewANSIConverter(&s.html)
+	}
+	s.offset += len(line)
+	s.html.Reset()
+	s.conv.Write(line)
+	s.conv.Flush()
+	fmt.Fprintf(s.w, "id: %d\ndata: %s\n\n", s.offset, strings.TrimSuffix(s.html.String(), "\n"))
+}
+
+func (s *sseLog) reset() {
+	s.offset = 0
+	s.partial = nil
+	s.conv = nil
+	fmt.Fprint(s.w, "event: reset\nid: 0\ndata:\n\n")
+}
+
+func (s *sseLog) finish(status string) {
+	if len(s.partial) != 0 {
+		s.send(s.partial)
+		s.partial = nil
+	}
+	fmt.Fprintf(s.w, "event: status\ndata: %s\n\n", status)
+}